@@ -0,0 +1,184 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"strconv"
+
+	"github.com/AspieSoft/goutil/v7"
+)
+
+// ErrConflict is returned when the stored value does not match the expected value
+var ErrConflict = errors.New("value was changed by another caller")
+
+// CompareAndSet changes the value of the row, only if its stored value is still equal to old
+//
+// the stored value is read again under the database lock, so changes made by another handle are not lost
+//
+// if the value does not match, the row is updated with the stored value, and ErrConflict is returned,
+// so the caller can retry with the new value
+func (row *Row) CompareAndSet(old string, value string, noLock ...bool) error {
+	return row.CompareAndSetContext(context.Background(), old, value, noLock...)
+}
+
+// CompareAndSetContext is the same as CompareAndSet, but gives up waiting for the database lock,
+// and stops scanning, once the context is done
+func (row *Row) CompareAndSetContext(ctx context.Context, old string, value string, noLock ...bool) error {
+	oldB := goutil.Clean.Bytes([]byte(old))
+	oldB = bytes.TrimLeftFunc(oldB, func(r rune) bool {
+		return r == 0
+	})
+
+	valB := goutil.Clean.Bytes([]byte(value))
+	valB = bytes.TrimLeftFunc(valB, func(r rune) bool {
+		return r == 0
+	})
+
+	if len(noLock) == 0 || noLock[0] == false {
+		if err := row.table.db.lockContext(ctx); err != nil {
+			return err
+		}
+		defer row.table.db.mu.Unlock()
+	}
+
+	current, err := row.stored(ctx)
+	if err != nil {
+		return err
+	}
+
+	// the write keeps the expiry, columns, and history of the stored row, even if they were changed through another handle
+	row.Value = current.Value
+	row.header = current.header
+	row.cols = current.cols
+
+	if current.Value != string(oldB) {
+		return ErrConflict
+	}
+
+	return row.setValue(ctx, valB, true)
+}
+
+// stored reads the current state of the row from the database
+//
+// the database lock must already be held by the caller
+func (row *Row) stored(ctx context.Context) (*Row, error) {
+	if err := row.checkStale(); err != nil {
+		return nil, err
+	}
+
+	keyB := []byte(row.Key)
+
+	row.table.db.file.Seek(row.line * int64(row.table.db.bitSize), io.SeekStart)
+	rw, err := scanDataObj(ctx, row.table.db, ':', row.table.rowMatch(func(k, v []byte) bool {
+		return bytes.Equal(k, keyB)
+	}), true)
+	if err != nil {
+		if err == context.Canceled || err == context.DeadlineExceeded {
+			return nil, err
+		}
+		return nil, errors.New("row does not exist")
+	}
+
+	return row.table.rowFromObj(rw), nil
+}
+
+// CompareAndSet changes the value of the key value pair, only if its stored value is still equal to old
+//
+// if the value does not match, the data is updated with the stored value, and ErrConflict is returned
+func (data *Data) CompareAndSet(old string, value string, noLock ...bool) error {
+	return data.CompareAndSetContext(context.Background(), old, value, noLock...)
+}
+
+// CompareAndSetContext is the same as CompareAndSet, but gives up waiting for the database lock,
+// and stops scanning, once the context is done
+func (data *Data) CompareAndSetContext(ctx context.Context, old string, value string, noLock ...bool) error {
+	oldB := goutil.Clean.Bytes([]byte(old))
+	oldB = bytes.TrimLeftFunc(oldB, func(r rune) bool {
+		return r == 0
+	})
+
+	valB := goutil.Clean.Bytes([]byte(value))
+	valB = bytes.TrimLeftFunc(valB, func(r rune) bool {
+		return r == 0
+	})
+
+	if len(noLock) == 0 || noLock[0] == false {
+		if err := data.db.lockContext(ctx); err != nil {
+			return err
+		}
+		defer data.db.mu.Unlock()
+	}
+
+	if err := data.checkStale(); err != nil {
+		return err
+	}
+
+	keyB := []byte(data.Key)
+
+	data.db.file.Seek(data.line * int64(data.db.bitSize), io.SeekStart)
+	dt, err := scanDataObj(ctx, data.db, '~', func(k, v []byte) bool {
+		return bytes.Equal(k, keyB)
+	}, true)
+	if err != nil {
+		if err == context.Canceled || err == context.DeadlineExceeded {
+			return err
+		}
+		return errors.New("data does not exist")
+	}
+
+	if !bytes.Equal(dt.val, oldB) {
+		data.Value = string(dt.val)
+		return ErrConflict
+	}
+
+	return data.setValue(ctx, valB, true)
+}
+
+// Increment adds delta to the integer value of a row, and returns the new value
+//
+// if the row does not exist, it is added with a value of delta
+//
+// the value is read and written under the database lock, so concurrent increments are never lost
+func (table *Table) Increment(key string, delta int64, noLock ...bool) (int64, error) {
+	return table.IncrementContext(context.Background(), key, delta, noLock...)
+}
+
+// IncrementContext is the same as Increment, but gives up waiting for the database lock,
+// and stops scanning, once the context is done
+func (table *Table) IncrementContext(ctx context.Context, key string, delta int64, noLock ...bool) (int64, error) {
+	if len(noLock) == 0 || noLock[0] == false {
+		if err := table.db.lockContext(ctx); err != nil {
+			return 0, err
+		}
+		defer table.db.mu.Unlock()
+	}
+
+	row, err := table.GetRowContext(ctx, key, true)
+	if err == context.Canceled || err == context.DeadlineExceeded {
+		return 0, err
+	}else if err != nil {
+		_, err = table.AddRowContext(ctx, key, strconv.FormatInt(delta, 10), true)
+		if err != nil {
+			return 0, err
+		}
+		return delta, nil
+	}
+
+	val := int64(0)
+	if row.Value != "" {
+		val, err = strconv.ParseInt(row.Value, 10, 64)
+		if err != nil {
+			return 0, errors.New("row \""+row.Key+"\" does not hold an integer value")
+		}
+	}
+
+	val += delta
+
+	if err := row.setValue(ctx, []byte(strconv.FormatInt(val, 10)), true); err != nil {
+		return 0, err
+	}
+
+	return val, nil
+}
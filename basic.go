@@ -2,12 +2,15 @@ package db
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"io"
 	"os"
 	"strconv"
+	"strings"
 
 	"github.com/AspieSoft/goutil/v7"
+	"github.com/alphadose/haxmap"
 )
 
 type Table struct {
@@ -15,14 +18,26 @@ type Table struct {
 	Name string
 	key []byte
 	val []byte
+	meta tableMeta
 	line int64
+	gen uint64
 }
 
+// ErrTableDeleted is returned by a table, or one of its rows, after the table was removed from the database
+var ErrTableDeleted = errors.New("table was deleted")
+
+// ErrStaleHandle is returned by a handle after the record it points to was removed or moved,
+// so it never changes an unrelated record that reused the same block
+var ErrStaleHandle = errors.New("handle is stale, the record was removed or moved")
+
 type Row struct {
 	table *Table
 	Key string
 	Value string
+	header rowHeader
+	cols []rowColumn
 	line int64
+	gen uint64
 }
 
 type Data struct {
@@ -30,78 +45,197 @@ type Data struct {
 	Key string
 	Value string
 	line int64
+	gen uint64
 }
 
 
 // Optimize will optimize a database file by cloning the tables and their rows to a new file
 //
-// this method will remove any orphaned data (rows without a table, etc),
+// this method will remove any orphaned data (rows without a table, expired rows, etc),
 // and will move existing tables to the top of the database file for quicker access
 //
 // row indexes are referenced from the tables, so having tables at the top is best for performance
+//
+// every record is moved to a new block, so existing Table, Row, and Data handles will return ErrStaleHandle,
+// and need to be retrieved again
+//
+// note: a database opened with WithStorage cannot be optimized, since its storage cannot be replaced
 func (db *Database) Optimize() error {
-	return errors.New("Database optimization is temporary unavailable! This method is not yet compatible with the current algorithm!")
-
 	db.mu.Lock()
 	defer db.mu.Unlock()
 
+	if err := db.checkWritable(); err != nil {
+		return err
+	}
+
+	if cow, ok := db.file.(*cowFile); ok && cow.hasSnapshots() {
+		return errors.New("cannot optimize the database while a snapshot is open")
+	}
+
+	// other processes would keep using the old file after it is replaced
+	if db.mode == ModeShared {
+		return errors.New("cannot optimize a database opened with ModeShared")
+	}
+
+	// a custom storage cannot be replaced, and rewriting it in place would lose the database if it fails part way
+	if db.customStorage {
+		return errors.New("cannot optimize a database opened with WithStorage")
+	}
+
 	db.file.Sync()
 
-	file, err := os.OpenFile(db.path+".opt", os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0755)
+	opts := []Option{WithKey(db.encKey), WithBitSize(db.bitSize), WithCompression(db.compress), WithTextLayout(db.textLayout)}
+
+	optPath := strings.TrimSuffix(db.path, ".db")+".opt.db"
+	os.Remove(optPath)
+
+	newDB, err := Open(optPath, opts...)
 	if err != nil {
 		return err
 	}
-	defer file.Close()
 
-	newDB := &Database{
-		file: file,
-		path: db.path+".opt",
-		bitSize: db.bitSize,
-		prefixList: db.prefixList,
-		encKey: db.encKey,
-		cache: db.cache,
+	discard := func(){
+		newDB.Close()
+		os.Remove(optPath)
 	}
 
-	//todo: fix database to include default #data (#bit, #enc, etc.)
+	ctx := context.Background()
 
-	if dataList, err := db.FindData([]byte{0}, []byte{0}, true); err == nil {
-		for _, data := range dataList {
-			newDB.AddData(data.Key, data.Value)
-		}
+	tableList, err := db.FindTablesMatchContext(ctx, Any(), true)
+	if err != nil && err != io.EOF {
+		discard()
+		return err
 	}
 
-	if tableList, err := db.FindTables([]byte{0}, true); err == nil {
-		newTables := make([]*Table, len(tableList))
-		for i, table := range tableList {
-			if tb, err := newDB.AddTable(table.Name); err == nil {
-				newTables[i] = tb
-			}
+	newTables := make([]*Table, len(tableList))
+	for i, table := range tableList {
+		tb, err := newDB.AddTable(table.Name, true)
+		if err != nil {
+			discard()
+			return err
 		}
+		tb.meta = table.meta
+		newTables[i] = tb
+	}
 
-		for i, table := range tableList {
-			if tb := newTables[i]; tb != nil {
-				if rowList, err := table.FindRows([]byte{0}, []byte{0}, true); err == nil {
-					for _, row := range rowList {
-						tb.AddRow(row.Key, row.Value)
+	for i, table := range tableList {
+		tb := newTables[i]
+
+		// rows are known to be unique, so the row list only needs to be written once
+		rowLines := [][]byte{}
+		var writeErr error
+		err = table.eachRow(ctx, func(k, v []byte) bool {
+			return true
+		}, func(row *Row) bool {
+			if histLine := row.header.history; histLine != 0 {
+				// history that can no longer be read is orphaned, so it is left behind like any other orphaned data
+				row.header.history = 0
+				if hist, err := table.readHistory(histLine); err == nil {
+					obj, err := addDataObj(newDB, '^', []byte(row.Key), hist.encode())
+					if err != nil {
+						writeErr = err
+						return false
 					}
+					row.header.history = obj.line
 				}
 			}
+
+			rw, err := addDataObj(newDB, ':', []byte(row.Key), row.encodeVal())
+			if err != nil {
+				writeErr = err
+				return false
+			}
+			rowLines = append(rowLines, []byte(strconv.FormatInt(rw.line, 36)))
+			return true
+		})
+		if err == nil {
+			err = writeErr
+		}
+		if err != nil {
+			discard()
+			return err
+		}
+
+		tb.val = bytes.Join(rowLines, []byte{','})
+		newDB.file.Seek(tb.line * int64(newDB.bitSize), io.SeekStart)
+		if _, err := setDataObj(newDB, '$', tb.key, tb.encodeVal()); err != nil {
+			discard()
+			return err
 		}
 	}
 
+	var writeErr error
+	err = db.eachData(ctx, func(k, v []byte) bool {
+		return true
+	}, func(data *Data) bool {
+		if _, err := addDataObj(newDB, '~', []byte(data.Key), []byte(data.Value)); err != nil {
+			writeErr = err
+			return false
+		}
+		return true
+	})
+	if err == nil {
+		err = writeErr
+	}
+	if err != nil {
+		discard()
+		return err
+	}
 
-	file.Sync()
-	file.Close()
-	db.file.Close()
-	os.Remove(db.path)
-	os.Rename(db.path+".opt", db.path)
+	if err := newDB.Close(); err != nil {
+		os.Remove(optPath)
+		return err
+	}
 
-	file, err = os.OpenFile(db.path, os.O_CREATE|os.O_RDWR, 0755)
-	db.file = file
+	// the new file is locked before it replaces the old one, so another process cannot take the lock in between
+	optFile, err := os.OpenFile(optPath, os.O_RDWR, 0755)
 	if err != nil {
+		os.Remove(optPath)
+		return err
+	}
+	if db.mode == ModeExclusive {
+		if err := lockFile(optFile, true, false); err != nil {
+			optFile.Close()
+			os.Remove(optPath)
+			return err
+		}
+	}
+
+	db.storage.Close()
+	if err := os.Rename(optPath, db.path); err != nil {
+		optFile.Close()
+		os.Remove(optPath)
+		file, e := os.OpenFile(db.path, os.O_CREATE|os.O_RDWR, 0755)
+		if e == nil {
+			db.setFile(file)
+		}
 		return err
 	}
 
+	// the renamed file is the same one that was locked, so its descriptor is kept
+	db.storage = FileStorage{optFile}
+	db.file = &cowFile{dbFile: &storageFile{Storage: db.storage}}
+
+	// every record has moved, so every existing handle is now stale
+	db.genCount++
+	db.minGen = db.genCount
+	db.gens = map[int64]uint64{}
+	db.cache = haxmap.New[string, *Table]()
+	db.tableCount = -1
+	db.dataCount = -1
+
+	return nil
+}
+
+
+// setFile replaces the file of the database, and takes the lock for ModeExclusive again
+func (db *Database) setFile(file *os.File) error {
+	db.storage = FileStorage{file}
+	db.file = &cowFile{dbFile: &storageFile{Storage: db.storage}}
+
+	if db.mode == ModeExclusive {
+		return lockFile(file, true, false)
+	}
 	return nil
 }
 
@@ -110,6 +244,12 @@ func (db *Database) Optimize() error {
 //
 // this method returns the new data
 func (db *Database) AddData(key string, value string, noLock ...bool) (*Data, error) {
+	return db.AddDataContext(context.Background(), key, value, noLock...)
+}
+
+// AddDataContext is the same as AddData, but gives up waiting for the database lock,
+// and stops scanning, once the context is done
+func (db *Database) AddDataContext(ctx context.Context, key string, value string, noLock ...bool) (*Data, error) {
 	keyB := goutil.Clean.Bytes([]byte(key))
 	keyB = bytes.TrimLeftFunc(keyB, func(r rune) bool {
 		return r == 0
@@ -120,65 +260,78 @@ func (db *Database) AddData(key string, value string, noLock ...bool) (*Data, er
 		return r == 0
 	})
 
+	return db.addData(ctx, keyB, valB, noLock...)
+}
+
+// addData adds a new key value pair without sanitizing the value
+func (db *Database) addData(ctx context.Context, keyB []byte, valB []byte, noLock ...bool) (*Data, error) {
 	if len(noLock) == 0 || noLock[0] == false {
-		db.mu.Lock()
+		if err := db.lockContext(ctx); err != nil {
+			return &Data{db: db}, err
+		}
 		defer db.mu.Unlock()
 	}
 
 	// ensure data does not already exist
 	db.file.Seek(0, io.SeekStart)
-	if data, err := getDataObj(db, '~', keyB, []byte{0}); err == nil {
-		return &Data{
-			db: db,
-			Key: string(data.key),
-			Value: string(data.val),
-			line: data.line,
-		}, errors.New("data key already exists")
+	if data, err := getDataObjCtx(ctx, db, '~', keyB, []byte{0}); err == nil {
+		return db.dataFromObj(data), errors.New("data key already exists")
+	}else if err != io.EOF {
+		// the scan did not finish, so the key may still exist
+		return &Data{db: db}, err
 	}
 
-	data, err := addDataObj(db, '~', keyB, []byte{})
+	if err := db.beforeWrite(Change{Op: OpAddData, Key: string(keyB), NewValue: string(valB)}); err != nil {
+		return &Data{db: db}, err
+	}
+
+	data, err := addDataObj(db, '~', keyB, valB)
 	if err != nil {
 		return &Data{db: db}, err
 	}
 
-	newData := &Data{
-		db: db,
-		Key: string(data.key),
-		Value: string(data.val),
-		line: data.line,
+	if db.dataCount != -1 {
+		db.dataCount++
 	}
 
+	newData := db.dataFromObj(data)
+
+	err = db.notify(Change{Op: OpAddData, Key: newData.Key, NewValue: newData.Value})
+
 	//todo: add data to cache
 
-	return newData, nil
+	return newData, db.syncWrite(err)
 }
 
 // GetData retrieves an existing key value pair from the database
 func (db *Database) GetData(key string, noLock ...bool) (*Data, error) {
+	return db.GetDataContext(context.Background(), key, noLock...)
+}
+
+// GetDataContext is the same as GetData, but gives up waiting for the database lock,
+// and stops scanning, once the context is done
+func (db *Database) GetDataContext(ctx context.Context, key string, noLock ...bool) (*Data, error) {
 	keyB := goutil.Clean.Bytes([]byte(key))
 	keyB = bytes.TrimLeftFunc(keyB, func(r rune) bool {
 		return r == 0
 	})
 
 	if len(noLock) == 0 || noLock[0] == false {
-		db.mu.Lock()
-		defer db.mu.Unlock()
+		if err := db.rlockContext(ctx); err != nil {
+			return &Data{db: db}, err
+		}
+		defer db.mu.RUnlock()
 	}
 
 	//todo: get table from cache
 
 	db.file.Seek(0, io.SeekStart)
-	data, err := getDataObj(db, '~', keyB, []byte{0})
+	data, err := getDataObjCtx(ctx, db, '~', keyB, []byte{0})
 	if err != nil {
 		return &Data{db: db}, err
 	}
 
-	newData := &Data{
-		db: db,
-		Key: string(data.key),
-		Value: string(data.val),
-		line: data.line,
-	}
+	newData := db.dataFromObj(data)
 
 	//todo: add table to cache
 
@@ -195,31 +348,49 @@ func (db *Database) GetData(key string, noLock ...bool) (*Data, error) {
 //
 // if you are dealing with user input, it is recommended to sanitize it and remove the first byte of 0,
 // to ensure the input cannot run regex, and will be treated as a literal string
+//
+// alternatively, FindDataMatch accepts a Matcher, which will never run regex by accident
 func (db *Database) FindData(key []byte, value []byte, noLock ...bool) ([]*Data, error) {
+	return db.FindDataContext(context.Background(), key, value, noLock...)
+}
+
+// FindDataContext is the same as FindData, but gives up waiting for the database lock,
+// and stops scanning, once the context is done
+func (db *Database) FindDataContext(ctx context.Context, key []byte, value []byte, noLock ...bool) ([]*Data, error) {
+	return db.FindDataMatchContext(ctx, legacyMatcher(key), legacyMatcher(value), noLock...)
+}
+
+// FindDataMatch finds a list of key value pairs with a key and value accepted by the matchers
+func (db *Database) FindDataMatch(key Matcher, value Matcher, noLock ...bool) ([]*Data, error) {
+	return db.FindDataMatchContext(context.Background(), key, value, noLock...)
+}
+
+// FindDataMatchContext is the same as FindDataMatch, but gives up waiting for the database lock,
+// and stops scanning, once the context is done
+func (db *Database) FindDataMatchContext(ctx context.Context, key Matcher, value Matcher, noLock ...bool) ([]*Data, error) {
 	resData := []*Data{}
 
-	if len(noLock) == 0 || noLock[0] == false {
-		db.mu.Lock()
-		defer db.mu.Unlock()
+	if key.err != nil {
+		return []*Data{}, key.err
+	}else if value.err != nil {
+		return []*Data{}, value.err
 	}
 
-	db.file.Seek(0, io.SeekStart)
-	for {
-		data, err := getDataObj(db, '~', key, value)
-		if err != nil {
-			break
-		}
-
-		newData := &Data{
-			db: db,
-			Key: string(data.key),
-			Value: string(data.val),
-			line: data.line,
+	if len(noLock) == 0 || noLock[0] == false {
+		if err := db.rlockContext(ctx); err != nil {
+			return []*Data{}, err
 		}
-	
-		//todo: add table to cache
+		defer db.mu.RUnlock()
+	}
 
-		resData = append(resData, newData)
+	err := db.eachData(ctx, func(k, v []byte) bool {
+		return key.Match(k) && value.Match(v)
+	}, func(data *Data) bool {
+		resData = append(resData, data)
+		return true
+	})
+	if err != nil {
+		return resData, err
 	}
 
 	if len(resData) == 0 {
@@ -231,13 +402,36 @@ func (db *Database) FindData(key []byte, value []byte, noLock ...bool) ([]*Data,
 
 // Del removes the key value pair from the database
 func (data *Data) Del(noLock ...bool) error {
+	return data.DelContext(context.Background(), noLock...)
+}
+
+// DelContext is the same as Del, but gives up waiting for the database lock,
+// and stops scanning, once the context is done
+func (data *Data) DelContext(ctx context.Context, noLock ...bool) error {
 	if len(noLock) == 0 || noLock[0] == false {
-		data.db.mu.Lock()
+		if err := data.db.lockContext(ctx); err != nil {
+			return err
+		}
 		defer data.db.mu.Unlock()
 	}
+
+	if err := data.checkStale(); err != nil {
+		return err
+	}
+
+	if err := data.db.beforeWrite(Change{Op: OpDelData, Key: data.Key, OldValue: data.Value}); err != nil {
+		return err
+	}
 	
 	data.db.file.Seek(data.line * int64(data.db.bitSize), io.SeekStart)
-	_, err := delDataObj(data.db, '~')
+	dt, err := delDataObj(data.db, '~')
+	if err == nil && dt.line == data.line && data.db.dataCount > 0 {
+		data.db.dataCount--
+	}
+
+	if err == nil {
+		err = data.db.syncWrite(data.db.notify(Change{Op: OpDelData, Key: data.Key, OldValue: data.Value}))
+	}
 
 	data.line = -1
 
@@ -246,21 +440,42 @@ func (data *Data) Del(noLock ...bool) error {
 
 // SetValue changes the value of the row
 func (data *Data) SetValue(value string, noLock ...bool) error {
+	return data.SetValueContext(context.Background(), value, noLock...)
+}
+
+// SetValueContext is the same as SetValue, but gives up waiting for the database lock,
+// and stops scanning, once the context is done
+func (data *Data) SetValueContext(ctx context.Context, value string, noLock ...bool) error {
 	valB := goutil.Clean.Bytes([]byte(value))
 	valB = bytes.TrimLeftFunc(valB, func(r rune) bool {
 		return r == 0
 	})
 
+	return data.setValue(ctx, valB, noLock...)
+}
+
+// setValue changes the value without sanitizing it
+func (data *Data) setValue(ctx context.Context, valB []byte, noLock ...bool) error {
 	if len(noLock) == 0 || noLock[0] == false {
-		data.db.mu.Lock()
+		if err := data.db.lockContext(ctx); err != nil {
+			return err
+		}
 		defer data.db.mu.Unlock()
 	}
 
+	if err := data.checkStale(); err != nil {
+		return err
+	}
+
 	keyB := goutil.Clean.Bytes([]byte(data.Key))
 	keyB = bytes.TrimLeftFunc(keyB, func(r rune) bool {
 		return r == 0
 	})
 
+	if err := data.db.beforeWrite(Change{Op: OpSetData, Key: data.Key, OldValue: data.Value, NewValue: string(valB)}); err != nil {
+		return err
+	}
+
 	data.db.file.Seek(data.line * int64(data.db.bitSize), io.SeekStart)
 	dt, err := setDataObj(data.db, '~', keyB, valB)
 	if err != nil {
@@ -272,7 +487,7 @@ func (data *Data) SetValue(value string, noLock ...bool) error {
 
 	//todo: add row to table cache
 
-	return nil
+	return data.db.syncWrite(data.db.notify(Change{Op: OpSetData, Key: data.Key, OldValue: string(dt.oldVal), NewValue: data.Value}))
 }
 
 
@@ -280,26 +495,35 @@ func (data *Data) SetValue(value string, noLock ...bool) error {
 //
 // this method returns the new table
 func (db *Database) AddTable(name string, noLock ...bool) (*Table, error) {
+	return db.AddTableContext(context.Background(), name, noLock...)
+}
+
+// AddTableContext is the same as AddTable, but gives up waiting for the database lock,
+// and stops scanning, once the context is done
+func (db *Database) AddTableContext(ctx context.Context, name string, noLock ...bool) (*Table, error) {
 	keyB := goutil.Clean.Bytes([]byte(name))
 	keyB = bytes.TrimLeftFunc(keyB, func(r rune) bool {
 		return r == 0
 	})
 
 	if len(noLock) == 0 || noLock[0] == false {
-		db.mu.Lock()
+		if err := db.lockContext(ctx); err != nil {
+			return &Table{db: db}, err
+		}
 		defer db.mu.Unlock()
 	}
 
 	// ensure table does not already exist
 	db.file.Seek(0, io.SeekStart)
-	if table, err := getDataObj(db, '$', keyB, []byte{0}); err == nil {
-		return &Table{
-			db: db,
-			Name: string(table.key),
-			key: table.key,
-			val: table.val,
-			line: table.line,
-		}, errors.New("table already exists")
+	if table, err := getDataObjCtx(ctx, db, '$', keyB, []byte{0}); err == nil {
+		return tableFromObj(db, table), errors.New("table already exists")
+	}else if err != io.EOF {
+		// the scan did not finish, so the table may still exist
+		return &Table{db: db}, err
+	}
+
+	if err := db.beforeWrite(Change{Op: OpAddTable, Table: string(keyB)}); err != nil {
+		return &Table{db: db}, err
 	}
 
 	table, err := addDataObj(db, '$', keyB, []byte{})
@@ -307,48 +531,44 @@ func (db *Database) AddTable(name string, noLock ...bool) (*Table, error) {
 		return &Table{db: db}, err
 	}
 
-	newTable := &Table{
-		db: db,
-		Name: string(table.key),
-		key: table.key,
-		val: table.val,
-		line: table.line,
+	if db.tableCount != -1 {
+		db.tableCount++
 	}
 
-	//todo: add table to cache
+	newTable := tableFromObj(db, table)
 
-	return newTable, nil
+	return newTable, db.syncWrite(db.notify(Change{Op: OpAddTable, Table: newTable.Name}))
 }
 
 // GetTable retrieves an existing table from the database
 func (db *Database) GetTable(name string, noLock ...bool) (*Table, error) {
+	return db.GetTableContext(context.Background(), name, noLock...)
+}
+
+// GetTableContext is the same as GetTable, but gives up waiting for the database lock,
+// and stops scanning, once the context is done
+func (db *Database) GetTableContext(ctx context.Context, name string, noLock ...bool) (*Table, error) {
 	keyB := goutil.Clean.Bytes([]byte(name))
 	keyB = bytes.TrimLeftFunc(keyB, func(r rune) bool {
 		return r == 0
 	})
 
 	if len(noLock) == 0 || noLock[0] == false {
-		db.mu.Lock()
-		defer db.mu.Unlock()
+		if err := db.rlockContext(ctx); err != nil {
+			return &Table{db: db}, err
+		}
+		defer db.mu.RUnlock()
 	}
 
 	//todo: get table from cache
 
 	db.file.Seek(0, io.SeekStart)
-	table, err := getDataObj(db, '$', keyB, []byte{0})
+	table, err := getDataObjCtx(ctx, db, '$', keyB, []byte{0})
 	if err != nil {
 		return &Table{db: db}, err
 	}
 
-	newTable := &Table{
-		db: db,
-		Name: string(table.key),
-		key: table.key,
-		val: table.val,
-		line: table.line,
-	}
-
-	//todo: add table to cache
+	newTable := tableFromObj(db, table)
 
 	return newTable, nil
 }
@@ -363,30 +583,49 @@ func (db *Database) GetTable(name string, noLock ...bool) (*Table, error) {
 //
 // if you are dealing with user input, it is recommended to sanitize it and remove the first byte of 0,
 // to ensure the input cannot run regex, and will be treated as a literal string
+//
+// alternatively, FindTablesMatch accepts a Matcher, which will never run regex by accident
 func (db *Database) FindTables(name []byte, noLock ...bool) ([]*Table, error) {
+	return db.FindTablesContext(context.Background(), name, noLock...)
+}
+
+// FindTablesContext is the same as FindTables, but gives up waiting for the database lock,
+// and stops scanning, once the context is done
+func (db *Database) FindTablesContext(ctx context.Context, name []byte, noLock ...bool) ([]*Table, error) {
+	return db.FindTablesMatchContext(ctx, legacyMatcher(name), noLock...)
+}
+
+// FindTablesMatch finds a list of tables with a name accepted by the matcher
+func (db *Database) FindTablesMatch(name Matcher, noLock ...bool) ([]*Table, error) {
+	return db.FindTablesMatchContext(context.Background(), name, noLock...)
+}
+
+// FindTablesMatchContext is the same as FindTablesMatch, but gives up waiting for the database lock,
+// and stops scanning, once the context is done
+func (db *Database) FindTablesMatchContext(ctx context.Context, name Matcher, noLock ...bool) ([]*Table, error) {
 	resTables := []*Table{}
 
+	if name.err != nil {
+		return []*Table{}, name.err
+	}
+
 	if len(noLock) == 0 || noLock[0] == false {
-		db.mu.Lock()
-		defer db.mu.Unlock()
+		if err := db.rlockContext(ctx); err != nil {
+			return []*Table{}, err
+		}
+		defer db.mu.RUnlock()
 	}
 
 	db.file.Seek(0, io.SeekStart)
 	for {
-		table, err := getDataObj(db, '$', name, []byte{0})
-		if err != nil {
+		table, err := matchDataObj(ctx, db, '$', name, Any())
+		if err == context.Canceled || err == context.DeadlineExceeded {
+			return resTables, err
+		}else if err != nil {
 			break
 		}
 
-		newTable := &Table{
-			db: db,
-			Name: string(table.key),
-			key: table.key,
-			val: table.val,
-			line: table.line,
-		}
-	
-		//todo: add table to cache
+		newTable := tableFromObj(db, table)
 
 		resTables = append(resTables, newTable)
 	}
@@ -400,52 +639,122 @@ func (db *Database) FindTables(name []byte, noLock ...bool) ([]*Table, error) {
 
 // Del removes the table from the database
 func (table *Table) Del(noLock ...bool) error {
+	return table.DelContext(context.Background(), noLock...)
+}
+
+// DelContext is the same as Del, but gives up waiting for the database lock,
+// and stops scanning, once the context is done
+func (table *Table) DelContext(ctx context.Context, noLock ...bool) error {
 	if len(noLock) == 0 || noLock[0] == false {
-		table.db.mu.Lock()
+		if err := table.db.lockContext(ctx); err != nil {
+			return err
+		}
 		defer table.db.mu.Unlock()
 	}
+
+	if err := table.checkDeleted(); err != nil {
+		return err
+	}
+
+	if err := table.db.beforeWrite(Change{Op: OpDelTable, Table: table.Name}); err != nil {
+		return err
+	}
 	
 	table.db.file.Seek(table.line * int64(table.db.bitSize), io.SeekStart)
-	_, err := delDataObj(table.db, '$')
+	tb, err := delDataObj(table.db, '$')
+	if err == nil && tb.line == table.line && table.db.tableCount > 0 {
+		table.db.tableCount--
+	}
 
 	rowList := bytes.Split(table.val, []byte{','})
 	for _, rowLine := range rowList {
 		if line, err := strconv.ParseInt(string(rowLine), 36, 64); err == nil {
-			table.db.file.Seek(line * int64(table.db.bitSize), io.SeekStart)
-			delDataObj(table.db, ':')
+			if rw, err := readObjAt(table.db, ':', line); err == nil {
+				header, _ := decodeRowVal(rw.val)
+				table.delRow(line, header)
+			}
 		}
 	}
 
+	// every handle shares this table, so they will all return ErrTableDeleted from now on
+	table.db.cache.Del(strconv.FormatInt(table.line, 36))
 	table.line = -1
 
+	if err == nil {
+		err = table.db.syncWrite(table.db.notify(Change{Op: OpDelTable, Table: table.Name}))
+	}
+
 	return err
 }
 
+// checkDeleted returns ErrTableDeleted if the table was removed from the database,
+// or ErrStaleHandle if its block no longer holds this table
+func (table *Table) checkDeleted() error {
+	if table.line == -1 {
+		return ErrTableDeleted
+	}else if table.gen != table.db.lineGen(table.line) {
+		return ErrStaleHandle
+	}
+	return nil
+}
+
+// checkStale returns an error if the row, or its table, no longer exists at the block the handle points to
+func (row *Row) checkStale() error {
+	if err := row.table.checkDeleted(); err != nil {
+		return err
+	}else if row.line == -1 || row.gen != row.table.db.lineGen(row.line) {
+		return ErrStaleHandle
+	}
+	return nil
+}
+
+// checkStale returns ErrStaleHandle if the key value pair no longer exists at the block the handle points to
+func (data *Data) checkStale() error {
+	if data.line == -1 || data.gen != data.db.lineGen(data.line) {
+		return ErrStaleHandle
+	}
+	return nil
+}
+
 // Rename changes the name of the table
 func (table *Table) Rename(name string, noLock ...bool) error {
+	return table.RenameContext(context.Background(), name, noLock...)
+}
+
+// RenameContext is the same as Rename, but gives up waiting for the database lock,
+// and stops scanning, once the context is done
+func (table *Table) RenameContext(ctx context.Context, name string, noLock ...bool) error {
 	keyB := goutil.Clean.Bytes([]byte(name))
 	keyB = bytes.TrimLeftFunc(keyB, func(r rune) bool {
 		return r == 0
 	})
 
 	if len(noLock) == 0 || noLock[0] == false {
-		table.db.mu.Lock()
+		if err := table.db.lockContext(ctx); err != nil {
+			return err
+		}
 		defer table.db.mu.Unlock()
 	}
 
+	if err := table.checkDeleted(); err != nil {
+		return err
+	}
+
+	if err := table.db.beforeWrite(Change{Op: OpRenameTable, Table: string(keyB), OldTable: table.Name}); err != nil {
+		return err
+	}
+
 	table.db.file.Seek(table.line * int64(table.db.bitSize), io.SeekStart)
-	tb, err := setDataObj(table.db, '$', keyB, table.val)
+	tb, err := setDataObj(table.db, '$', keyB, table.encodeVal())
 	if err != nil {
 		return err
 	}
 
+	oldName := table.Name
 	table.Name = string(tb.key)
 	table.key = tb.key
-	table.val = tb.val
-
-	//todo: add table to cache
 
-	return nil
+	return table.db.syncWrite(table.db.notify(Change{Op: OpRenameTable, Table: table.Name, OldTable: oldName}))
 }
 
 
@@ -453,6 +762,12 @@ func (table *Table) Rename(name string, noLock ...bool) error {
 //
 // this method returns the new row
 func (table *Table) AddRow(key string, value string, noLock ...bool) (*Row, error) {
+	return table.AddRowContext(context.Background(), key, value, noLock...)
+}
+
+// AddRowContext is the same as AddRow, but gives up waiting for the database lock,
+// and stops scanning, once the context is done
+func (table *Table) AddRowContext(ctx context.Context, key string, value string, noLock ...bool) (*Row, error) {
 	keyB := goutil.Clean.Bytes([]byte(key))
 	keyB = bytes.TrimLeftFunc(keyB, func(r rune) bool {
 		return r == 0
@@ -463,29 +778,54 @@ func (table *Table) AddRow(key string, value string, noLock ...bool) (*Row, erro
 		return r == 0
 	})
 
+	valB, err := table.storedRowVal(valB, rowHeader{})
+	if err != nil {
+		return &Row{table: table}, err
+	}
+
+	return table.addRow(ctx, keyB, valB, noLock...)
+}
+
+// addRow adds a new row with the data that should be stored for it
+func (table *Table) addRow(ctx context.Context, keyB []byte, valB []byte, noLock ...bool) (*Row, error) {
 	if len(noLock) == 0 || noLock[0] == false {
-		table.db.mu.Lock()
+		if err := table.db.lockContext(ctx); err != nil {
+			return &Row{table: table}, err
+		}
 		defer table.db.mu.Unlock()
 	}
 
+	if err := table.checkDeleted(); err != nil {
+		return &Row{table: table}, err
+	}
+
 	// ensure row does not already exist
-	rowList := bytes.Split(table.val, []byte{','})
-	for _, rowLine := range rowList {
-		if line, err := strconv.ParseInt(string(rowLine), 36, 64); err == nil {
-			table.db.file.Seek(line * int64(table.db.bitSize), io.SeekStart)
-			if row, err := getDataObj(table.db, ':', keyB, []byte{0}, true); err == nil {
-				newRow := &Row{
-					table: table,
-					Key: string(row.key),
-					Value: string(row.val),
-					line: row.line,
-				}
+	if row, err := table.existingRow(ctx, keyB, -1); err != nil {
+		return &Row{table: table}, err
+	}else if row != nil {
+		return row, errors.New("row already exists")
+	}
 
-				//todo: add row to table cache
+	_, value := table.rowData(valB)
+	if err := table.validateKey(keyB); err != nil {
+		return &Row{table: table}, err
+	}else if err := table.validateValue(value); err != nil {
+		return &Row{table: table}, err
+	}
 
-				return newRow, errors.New("row already exists")
-			}
+	if err := table.db.beforeWrite(Change{Op: OpAddRow, Table: table.Name, Key: string(keyB), NewValue: string(value)}); err != nil {
+		return &Row{table: table}, err
+	}
+
+	if table.meta.Versioning != nil {
+		histLine, err := table.newHistory(keyB)
+		if err != nil {
+			return &Row{table: table}, err
 		}
+
+		header, data := decodeRowVal(valB)
+		header.history = histLine
+		valB = encodeRowVal(header, data)
 	}
 
 	row, err := addDataObj(table.db, ':', keyB, valB)
@@ -499,45 +839,121 @@ func (table *Table) AddRow(key string, value string, noLock ...bool) (*Row, erro
 	}else{
 		table.val = append(table.val, append([]byte{','}, strconv.FormatInt(row.line, 36)...)...)
 	}
-	setDataObj(table.db, '$', table.key, table.val)
+	setDataObj(table.db, '$', table.key, table.encodeVal())
 
-	newRow := &Row{
-		table: table,
-		Key: string(row.key),
-		Value: string(row.val),
-		line: row.line,
-	}
+	newRow := table.rowFromObj(row)
 
 	//todo: add row to cache
 
-	return newRow, nil
+	return newRow, table.db.syncWrite(table.db.notify(Change{Op: OpAddRow, Table: table.Name, Key: newRow.Key, NewValue: newRow.Value}))
+}
+
+// existingRow finds a row in the table with the same key, ignoring the row at skipLine
+//
+// expired rows are treated as missing, and are removed, so their key can be used again
+//
+// @return nil if no row was found
+func (table *Table) existingRow(ctx context.Context, keyB []byte, skipLine int64) (*Row, error) {
+	expiredLines := map[int64]bool{}
+	defer func(){
+		if len(expiredLines) != 0 {
+			table.removeRowLines(expiredLines)
+		}
+	}()
+
+	rowList := bytes.Split(table.val, []byte{','})
+	for _, rowLine := range rowList {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		if line, err := strconv.ParseInt(string(rowLine), 36, 64); err == nil && line != skipLine {
+			table.db.file.Seek(line * int64(table.db.bitSize), io.SeekStart)
+			if row, err := getDataObjCtx(ctx, table.db, ':', keyB, []byte{0}, true); err == nil {
+				newRow := table.rowFromObj(row)
+
+				if newRow.header.expired() {
+					// an expired row is treated as missing, so it can be replaced
+					table.delRow(line, newRow.header)
+					expiredLines[line] = true
+					if err := table.db.notify(Change{Op: OpDelRow, Table: table.Name, Key: newRow.Key, OldValue: newRow.Value}); err != nil {
+						return nil, err
+					}
+					continue
+				}
+
+				//todo: add row to table cache
+
+				return newRow, nil
+			}else if ctxErr := ctx.Err(); ctxErr != nil {
+				// the row may have been the one with the same key
+				return nil, ctxErr
+			}
+		}
+	}
+
+	return nil, nil
+}
+
+// removeRowLines removes rows from the row list of the table, and stores the new row list
+//
+// the rows themselves are not removed from the database
+func (table *Table) removeRowLines(lines map[int64]bool) error {
+	rowList := bytes.Split(table.val, []byte{','})
+	newList := make([][]byte, 0, len(rowList))
+	for _, rowLine := range rowList {
+		if line, err := strconv.ParseInt(string(rowLine), 36, 64); err == nil && lines[line] {
+			continue
+		}else if len(rowLine) != 0 {
+			newList = append(newList, rowLine)
+		}
+	}
+
+	table.val = bytes.Join(newList, []byte{','})
+
+	table.db.file.Seek(table.line * int64(table.db.bitSize), io.SeekStart)
+	_, err := setDataObj(table.db, '$', table.key, table.encodeVal())
+	return err
 }
 
 // GetRow retrieves an existing row from the table
 func (table *Table) GetRow(key string, noLock ...bool) (*Row, error) {
+	return table.GetRowContext(context.Background(), key, noLock...)
+}
+
+// GetRowContext is the same as GetRow, but gives up waiting for the database lock,
+// and stops scanning, once the context is done
+func (table *Table) GetRowContext(ctx context.Context, key string, noLock ...bool) (*Row, error) {
 	keyB := goutil.Clean.Bytes([]byte(key))
 	keyB = bytes.TrimLeftFunc(keyB, func(r rune) bool {
 		return r == 0
 	})
 
 	if len(noLock) == 0 || noLock[0] == false {
-		table.db.mu.Lock()
-		defer table.db.mu.Unlock()
+		if err := table.db.rlockContext(ctx); err != nil {
+			return &Row{table: table}, err
+		}
+		defer table.db.mu.RUnlock()
+	}
+
+	if err := table.checkDeleted(); err != nil {
+		return &Row{table: table}, err
 	}
 
 	//todo: get row from table cache
 
 	rowList := bytes.Split(table.val, []byte{','})
 	for _, rowLine := range rowList {
+		if err := ctx.Err(); err != nil {
+			return &Row{table: table}, err
+		}
+
 		if line, err := strconv.ParseInt(string(rowLine), 36, 64); err == nil {
 			table.db.file.Seek(line * int64(table.db.bitSize), io.SeekStart)
-			if row, err := getDataObj(table.db, ':', keyB, []byte{0}, true); err == nil {
-				newRow := &Row{
-					table: table,
-					Key: string(row.key),
-					Value: string(row.val),
-					line: row.line,
-				}
+			if row, err := scanDataObj(ctx, table.db, ':', table.rowMatch(func(k, v []byte) bool {
+				return bytes.Equal(k, keyB)
+			}), true); err == nil {
+				newRow := table.rowFromObj(row)
 
 				//todo: add row to table cache
 
@@ -559,31 +975,49 @@ func (table *Table) GetRow(key string, noLock ...bool) (*Row, error) {
 //
 // if you are dealing with user input, it is recommended to sanitize it and remove the first byte of 0,
 // to ensure the input cannot run regex, and will be treated as a literal string
+//
+// alternatively, FindRowsMatch accepts a Matcher, which will never run regex by accident
 func (table *Table) FindRows(key []byte, value []byte, noLock ...bool) ([]*Row, error) {
-	resRow := []*Row{}
+	return table.FindRowsContext(context.Background(), key, value, noLock...)
+}
 
-	if len(noLock) == 0 || noLock[0] == false {
-		table.db.mu.Lock()
-		defer table.db.mu.Unlock()
-	}
+// FindRowsContext is the same as FindRows, but gives up waiting for the database lock,
+// and stops scanning, once the context is done
+func (table *Table) FindRowsContext(ctx context.Context, key []byte, value []byte, noLock ...bool) ([]*Row, error) {
+	return table.FindRowsMatchContext(ctx, legacyMatcher(key), legacyMatcher(value), noLock...)
+}
 
-	rowList := bytes.Split(table.val, []byte{','})
-	for _, rowLine := range rowList {
-		if line, err := strconv.ParseInt(string(rowLine), 36, 64); err == nil {
-			table.db.file.Seek(line * int64(table.db.bitSize), io.SeekStart)
-			if row, err := getDataObj(table.db, ':', key, value, true); err == nil {
-				newRow := &Row{
-					table: table,
-					Key: string(row.key),
-					Value: string(row.val),
-					line: row.line,
-				}
+// FindRowsMatch finds a list of rows with a key and value accepted by the matchers
+func (table *Table) FindRowsMatch(key Matcher, value Matcher, noLock ...bool) ([]*Row, error) {
+	return table.FindRowsMatchContext(context.Background(), key, value, noLock...)
+}
 
-				//todo: add row to table cache
+// FindRowsMatchContext is the same as FindRowsMatch, but gives up waiting for the database lock,
+// and stops scanning, once the context is done
+func (table *Table) FindRowsMatchContext(ctx context.Context, key Matcher, value Matcher, noLock ...bool) ([]*Row, error) {
+	resRow := []*Row{}
 
-				resRow = append(resRow, newRow)
-			}
+	if key.err != nil {
+		return []*Row{}, key.err
+	}else if value.err != nil {
+		return []*Row{}, value.err
+	}
+
+	if len(noLock) == 0 || noLock[0] == false {
+		if err := table.db.rlockContext(ctx); err != nil {
+			return []*Row{}, err
 		}
+		defer table.db.mu.RUnlock()
+	}
+
+	err := table.eachRow(ctx, func(k, v []byte) bool {
+		return key.Match(k) && value.Match(v)
+	}, func(row *Row) bool {
+		resRow = append(resRow, row)
+		return true
+	})
+	if err != nil {
+		return resRow, err
 	}
 
 	if len(resRow) == 0 {
@@ -593,79 +1027,205 @@ func (table *Table) FindRows(key []byte, value []byte, noLock ...bool) ([]*Row,
 	return resRow, nil
 }
 
-// DelRow removes the key value pair from the table
+// Del removes the key value pair from the table, and removes it from the row list of the table
 func (row *Row) Del(noLock ...bool) error {
+	return row.DelContext(context.Background(), noLock...)
+}
+
+// DelContext is the same as Del, but gives up waiting for the database lock,
+// and stops scanning, once the context is done
+func (row *Row) DelContext(ctx context.Context, noLock ...bool) error {
 	if len(noLock) == 0 || noLock[0] == false {
-		row.table.db.mu.Lock()
+		if err := row.table.db.lockContext(ctx); err != nil {
+			return err
+		}
 		defer row.table.db.mu.Unlock()
 	}
 
+	if err := row.checkStale(); err != nil {
+		return err
+	}
+
+	// only free the block if it still holds this row, so a reused block is never removed by mistake
+	keyB := []byte(row.Key)
 	row.table.db.file.Seek(row.line * int64(row.table.db.bitSize), io.SeekStart)
-	_, err := delDataObj(row.table.db, ':')
-	
+	rw, err := scanDataObj(ctx, row.table.db, ':', func(k, v []byte) bool {
+		return bytes.Equal(k, keyB)
+	}, true)
+	if err == context.Canceled || err == context.DeadlineExceeded {
+		return err
+	}else if err != nil {
+		err = errors.New("row does not exist")
+	}else if err = row.table.db.beforeWrite(Change{Op: OpDelRow, Table: row.table.Name, Key: row.Key, OldValue: row.Value}); err != nil {
+		return err
+	}else{
+		header, _ := decodeRowVal(rw.val)
+		if _, err = row.table.delRow(row.line, header); err == nil {
+			err = row.table.db.notify(Change{Op: OpDelRow, Table: row.table.Name, Key: row.Key, OldValue: row.Value})
+		}
+	}
+
+	if e := row.table.removeRowLines(map[int64]bool{row.line: true}); e != nil && err == nil {
+		err = e
+	}
+
 	row.line = -1
 
-	return err
+	return row.table.db.syncWrite(err)
 }
 
 // Rename changes the key of the row
+//
+// an error is returned if another row in the table already has this key
 func (row *Row) Rename(key string, noLock ...bool) error {
+	return row.RenameContext(context.Background(), key, noLock...)
+}
+
+// RenameContext is the same as Rename, but gives up waiting for the database lock,
+// and stops scanning, once the context is done
+func (row *Row) RenameContext(ctx context.Context, key string, noLock ...bool) error {
 	keyB := goutil.Clean.Bytes([]byte(key))
 	keyB = bytes.TrimLeftFunc(keyB, func(r rune) bool {
 		return r == 0
 	})
 
 	if len(noLock) == 0 || noLock[0] == false {
-		row.table.db.mu.Lock()
+		if err := row.table.db.lockContext(ctx); err != nil {
+			return err
+		}
 		defer row.table.db.mu.Unlock()
 	}
 
-	valB := goutil.Clean.Bytes([]byte(row.Value))
-	valB = bytes.TrimLeftFunc(valB, func(r rune) bool {
-		return r == 0
-	})
+	// another handle may have changed the row, so the stored row is written back with only the key changed
+	current, err := row.stored(ctx)
+	if err != nil {
+		return err
+	}
+	row.Value = current.Value
+	row.header = current.header
+	row.cols = current.cols
+
+	if string(keyB) != row.Key {
+		if rw, err := row.table.existingRow(ctx, keyB, row.line); err != nil {
+			return err
+		}else if rw != nil {
+			return errors.New("row already exists")
+		}
+	}
+
+	if string(keyB) != row.Key {
+		if err := row.table.validateKey(keyB); err != nil {
+			return err
+		}
+
+		if err := row.table.db.beforeWrite(Change{Op: OpRenameRow, Table: row.table.Name, Key: string(keyB), OldKey: row.Key, NewValue: row.Value}); err != nil {
+			return err
+		}
+	}
 
+	// the value is already stored, so it should not be sanitized again
 	row.table.db.file.Seek(row.line * int64(row.table.db.bitSize), io.SeekStart)
-	rw, err := setDataObj(row.table.db, ':', keyB, valB)
+	rw, err := setDataObj(row.table.db, ':', keyB, row.encodeVal())
 	if err != nil {
 		return err
 	}
 
+	oldKey := row.Key
 	row.Key = string(rw.key)
-	row.Value = string(rw.val)
 
 	//todo: add row to table cache
 
-	return nil
+	if row.Key != oldKey {
+		return row.table.db.syncWrite(row.table.db.notify(Change{Op: OpRenameRow, Table: row.table.Name, Key: row.Key, OldKey: oldKey, NewValue: row.Value}))
+	}
+
+	return row.table.db.syncWrite(nil)
 }
 
 // SetValue changes the value of the row
 func (row *Row) SetValue(value string, noLock ...bool) error {
+	return row.SetValueContext(context.Background(), value, noLock...)
+}
+
+// SetValueContext is the same as SetValue, but gives up waiting for the database lock,
+// and stops scanning, once the context is done
+func (row *Row) SetValueContext(ctx context.Context, value string, noLock ...bool) error {
 	valB := goutil.Clean.Bytes([]byte(value))
 	valB = bytes.TrimLeftFunc(valB, func(r rune) bool {
 		return r == 0
 	})
 
+	return row.setValue(ctx, valB, noLock...)
+}
+
+// setValue changes the value without sanitizing it
+func (row *Row) setValue(ctx context.Context, valB []byte, noLock ...bool) error {
+	return row.setValueExpire(ctx, valB, nil, noLock...)
+}
+
+// setValueExpire changes the value without sanitizing it
+//
+// @expire replaces the expiry of the row (nil = keep the stored expiry)
+func (row *Row) setValueExpire(ctx context.Context, valB []byte, expire *int64, noLock ...bool) error {
+	if len(row.table.meta.Columns) != 0 {
+		valB, err := row.table.meta.Columns[0].parse(valB)
+		if err != nil {
+			return err
+		}
+		return row.setColumn(ctx, row.table.firstColumn(), valB, expire, noLock...)
+	}
+
 	if len(noLock) == 0 || noLock[0] == false {
-		row.table.db.mu.Lock()
+		if err := row.table.db.lockContext(ctx); err != nil {
+			return err
+		}
 		defer row.table.db.mu.Unlock()
 	}
 
+	// another handle may have changed the expiry or history of the row, so the stored header is written back
+	current, err := row.stored(ctx)
+	if err != nil {
+		return err
+	}
+	row.Value = current.Value
+	row.header = current.header
+	row.cols = current.cols
+
 	keyB := goutil.Clean.Bytes([]byte(row.Key))
 	keyB = bytes.TrimLeftFunc(keyB, func(r rune) bool {
 		return r == 0
 	})
 
+	if err := row.table.validateValue(valB); err != nil {
+		return err
+	}
+
+	if err := row.table.db.beforeWrite(Change{Op: OpSetRow, Table: row.table.Name, Key: row.Key, OldValue: row.Value, NewValue: string(valB)}); err != nil {
+		return err
+	}
+
+	if err := row.pushHistory(); err != nil {
+		return err
+	}
+
+	oldValue := row.Value
+	row.Value = string(valB)
+	oldHeader := row.header
+	if expire != nil {
+		row.header.expire = *expire
+	}
+
 	row.table.db.file.Seek(row.line * int64(row.table.db.bitSize), io.SeekStart)
-	rw, err := setDataObj(row.table.db, ':', keyB, valB)
+	rw, err := setDataObj(row.table.db, ':', keyB, row.encodeVal())
 	if err != nil {
+		row.Value = oldValue
+		row.header = oldHeader
 		return err
 	}
 
 	row.Key = string(rw.key)
-	row.Value = string(rw.val)
 
 	//todo: add row to table cache
 
-	return nil
+	return row.table.db.syncWrite(row.table.db.notify(Change{Op: OpSetRow, Table: row.table.Name, Key: row.Key, OldValue: oldValue, NewValue: row.Value}))
 }
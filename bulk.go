@@ -0,0 +1,162 @@
+package db
+
+import (
+	"bytes"
+	"context"
+
+	"github.com/AspieSoft/goutil/v7"
+)
+
+// SetRow changes the value of a row, and adds the row if it does not exist yet
+//
+// unlike AddRow followed by SetValue, the row is checked and written under a single database lock
+func (table *Table) SetRow(key string, value string, noLock ...bool) (*Row, error) {
+	return table.SetRowContext(context.Background(), key, value, noLock...)
+}
+
+// SetRowContext is the same as SetRow, but gives up waiting for the database lock,
+// and stops scanning, once the context is done
+func (table *Table) SetRowContext(ctx context.Context, key string, value string, noLock ...bool) (*Row, error) {
+	keyB := goutil.Clean.Bytes([]byte(key))
+	keyB = bytes.TrimLeftFunc(keyB, func(r rune) bool {
+		return r == 0
+	})
+
+	valB := goutil.Clean.Bytes([]byte(value))
+	valB = bytes.TrimLeftFunc(valB, func(r rune) bool {
+		return r == 0
+	})
+
+	if len(noLock) == 0 || noLock[0] == false {
+		if err := table.db.lockContext(ctx); err != nil {
+			return &Row{table: table}, err
+		}
+		defer table.db.mu.Unlock()
+	}
+
+	row, err := table.GetRowContext(ctx, string(keyB), true)
+	if err == context.Canceled || err == context.DeadlineExceeded {
+		return &Row{table: table}, err
+	}else if err == nil {
+		return row, row.setValue(ctx, valB, true)
+	}
+
+	storedValB, err := table.storedRowVal(valB, rowHeader{})
+	if err != nil {
+		return &Row{table: table}, err
+	}
+
+	return table.addRow(ctx, keyB, storedValB, true)
+}
+
+// UpdateWhere changes the value of every row with a key accepted by the matcher
+//
+// fn receives the key and value of each row, and returns the new value,
+// or false to leave the row unchanged
+//
+// @return the number of rows changed
+func (table *Table) UpdateWhere(key Matcher, fn func(key string, value string) (string, bool), noLock ...bool) (int, error) {
+	return table.UpdateWhereContext(context.Background(), key, fn, noLock...)
+}
+
+// UpdateWhereContext is the same as UpdateWhere, but gives up waiting for the database lock,
+// and stops scanning, once the context is done
+func (table *Table) UpdateWhereContext(ctx context.Context, key Matcher, fn func(key string, value string) (string, bool), noLock ...bool) (int, error) {
+	if key.err != nil {
+		return 0, key.err
+	}
+
+	if len(noLock) == 0 || noLock[0] == false {
+		if err := table.db.lockContext(ctx); err != nil {
+			return 0, err
+		}
+		defer table.db.mu.Unlock()
+	}
+
+	count := 0
+	var setErr error
+	err := table.eachRow(ctx, func(k, v []byte) bool {
+		return key.Match(k)
+	}, func(row *Row) bool {
+		value, ok := fn(row.Key, row.Value)
+		if !ok {
+			return true
+		}
+
+		valB := goutil.Clean.Bytes([]byte(value))
+		valB = bytes.TrimLeftFunc(valB, func(r rune) bool {
+			return r == 0
+		})
+
+		if setErr = row.setValue(ctx, valB, true); setErr != nil {
+			return false
+		}
+
+		count++
+		return true
+	})
+
+	if setErr != nil {
+		return count, setErr
+	}
+	return count, err
+}
+
+// DeleteWhere removes every row with a key accepted by the matcher
+//
+// the row list of the table is only written once, after every row has been removed
+//
+// if a BeforeWrite hook cancels the removal of a row, the scan stops and the hook error is returned,
+// but rows that were already removed stay removed
+//
+// @return the number of rows removed
+func (table *Table) DeleteWhere(key Matcher, noLock ...bool) (int, error) {
+	return table.DeleteWhereContext(context.Background(), key, noLock...)
+}
+
+// DeleteWhereContext is the same as DeleteWhere, but gives up waiting for the database lock,
+// and stops scanning, once the context is done
+func (table *Table) DeleteWhereContext(ctx context.Context, key Matcher, noLock ...bool) (int, error) {
+	if key.err != nil {
+		return 0, key.err
+	}
+
+	if len(noLock) == 0 || noLock[0] == false {
+		if err := table.db.lockContext(ctx); err != nil {
+			return 0, err
+		}
+		defer table.db.mu.Unlock()
+	}
+
+	delLines := map[int64]bool{}
+	var hookErr, logErr error
+	err := table.eachRow(ctx, func(k, v []byte) bool {
+		return key.Match(k)
+	}, func(row *Row) bool {
+		if hookErr = table.db.beforeWrite(Change{Op: OpDelRow, Table: table.Name, Key: row.Key, OldValue: row.Value}); hookErr != nil {
+			return false
+		}
+
+		if _, err := table.delRow(row.line, row.header); err == nil {
+			delLines[row.line] = true
+			if e := table.db.notify(Change{Op: OpDelRow, Table: table.Name, Key: row.Key, OldValue: row.Value}); e != nil && logErr == nil {
+				logErr = e
+			}
+		}
+		return true
+	})
+
+	// rows that were already freed have to be removed from the row list, even if the context is done
+	if len(delLines) != 0 {
+		if e := table.removeRowLines(delLines); e != nil && err == nil {
+			err = e
+		}
+	}
+
+	if hookErr != nil {
+		return len(delLines), table.db.syncWrite(hookErr)
+	}else if logErr != nil {
+		return len(delLines), table.db.syncWrite(logErr)
+	}
+	return len(delLines), table.db.syncWrite(err)
+}
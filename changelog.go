@@ -0,0 +1,482 @@
+package db
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ChangeLogEntry is a single change stored in the change log
+type ChangeLogEntry struct {
+	// Seq increases by 1 for each change, and is never reused, even after the log is truncated
+	Seq uint64 `json:"seq"`
+
+	// Time is when the change was written, in unix milliseconds
+	Time int64 `json:"time"`
+
+	Change
+}
+
+// ChangeLogRetention controls how much of the change log is kept
+//
+// entries are removed when either limit is reached (0 = no limit)
+//
+// the latest entry is always kept, so the sequence can continue after a restart
+type ChangeLogRetention struct {
+	MaxEntries int
+	MaxAge time.Duration
+}
+
+// ChangeLogError is returned by a write that was stored in the database, but could not be written to the change log
+type ChangeLogError struct {
+	Err error
+}
+
+func (e *ChangeLogError) Error() string {
+	return "the change was stored, but not written to the change log: "+e.Err.Error()
+}
+
+func (e *ChangeLogError) Unwrap() error {
+	return e.Err
+}
+
+// changeLog is an append only file, with one json encoded ChangeLogEntry per line
+type changeLog struct {
+	file *os.File
+	path string
+	seq uint64
+	retention ChangeLogRetention
+
+	// the number of entries in the file, and the time of the oldest one
+	count int
+	oldest int64
+
+	// shared is true for ModeShared, where other processes append to the same log
+	shared bool
+
+	// size is the size of the file after the last entry that was written or read by this database
+	size int64
+
+	mu sync.Mutex
+}
+
+// EnableChangeLog starts writing every change to a log file next to the database (i.e. test.db -> test.changes)
+//
+// if the log already exists, its sequence continues from the last entry
+func (db *Database) EnableChangeLog(retention ChangeLogRetention, noLock ...bool) error {
+	if len(noLock) == 0 || noLock[0] == false {
+		db.mu.Lock()
+		defer db.mu.Unlock()
+	}
+
+	if err := db.checkWritable(); err != nil {
+		return err
+	}
+
+	if db.changeLog != nil {
+		db.changeLog.mu.Lock()
+		db.changeLog.retention = retention
+		db.changeLog.mu.Unlock()
+		return nil
+	}
+
+	if db.path == "" {
+		return errors.New("the change log needs a database path")
+	}
+	path := strings.TrimSuffix(db.path, ".db")+".changes"
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0755)
+	if err != nil {
+		return err
+	}
+
+	if err := repairLog(file); err != nil {
+		file.Close()
+		return err
+	}
+
+	cl := &changeLog{
+		file: file,
+		path: path,
+		retention: retention,
+		shared: db.mode == ModeShared,
+	}
+
+	if err := cl.load(); err != nil {
+		file.Close()
+		return err
+	}
+
+	db.changeLog = cl
+	return nil
+}
+
+// ChangeLogSeq returns the sequence number of the latest change in the log
+//
+// with ModeShared, this waits for the database lock, since the log may have been changed by another process
+func (db *Database) ChangeLogSeq(noLock ...bool) (uint64, error) {
+	cl := db.changeLog
+	if cl == nil {
+		return 0, errors.New("change log is not enabled")
+	}
+
+	if cl.shared && (len(noLock) == 0 || noLock[0] == false) {
+		db.mu.RLock()
+		defer db.mu.RUnlock()
+	}
+
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+
+	if cl.shared {
+		if err := cl.reload(); err != nil {
+			return 0, err
+		}
+	}
+
+	return cl.seq, nil
+}
+
+// ReadChangeLog calls each for every entry in the change log with a sequence number after afterSeq, until each returns false
+//
+// a consumer can store the Seq of the last entry it handled, and resume from it after a restart
+//
+// if entries after afterSeq were already removed by the retention policy, the oldest remaining entries are read
+//
+// the log is not locked while each runs, so it can write to the database
+func (db *Database) ReadChangeLog(afterSeq uint64, each func(entry ChangeLogEntry) bool) error {
+	cl := db.changeLog
+	if cl == nil {
+		return errors.New("change log is not enabled")
+	}
+
+	// a truncate replaces the file, so it is opened under the lock,
+	// and only the entries that were already written are read, since each may append more
+	cl.mu.Lock()
+	file, err := os.Open(cl.path)
+	var size int64
+	if err == nil {
+		var stat os.FileInfo
+		if stat, err = file.Stat(); err == nil {
+			size = stat.Size()
+		}else{
+			file.Close()
+		}
+	}
+	cl.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return readLog(io.LimitReader(file, size), afterSeq, each)
+}
+
+// TruncateChangeLog removes the entries that are no longer kept by the retention policy
+//
+// with ModeShared, this waits for the database lock, since other processes append to the same log
+func (db *Database) TruncateChangeLog(noLock ...bool) error {
+	cl := db.changeLog
+	if cl == nil {
+		return errors.New("change log is not enabled")
+	}
+
+	// with ModeShared, the database lock keeps other processes from appending to the log while it is rewritten
+	if cl.shared && (len(noLock) == 0 || noLock[0] == false) {
+		db.mu.Lock()
+		defer db.mu.Unlock()
+	}
+
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+
+	if cl.shared {
+		if err := cl.reload(); err != nil {
+			return err
+		}
+	}
+
+	return cl.truncate()
+}
+
+// logChange appends a change to the change log, if it is enabled
+//
+// the database lock must already be held by the caller, so the sequence matches the order of the writes
+func (db *Database) logChange(change Change) error {
+	cl := db.changeLog
+	if cl == nil {
+		return nil
+	}
+
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+
+	// the file lock is held, so the entries of other processes can be read before the sequence continues
+	if cl.shared {
+		if err := cl.reload(); err != nil {
+			return err
+		}
+	}
+
+	entry := ChangeLogEntry{
+		Seq: cl.seq+1,
+		Time: time.Now().UnixMilli(),
+		Change: change,
+	}
+
+	buf, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	if _, err = cl.file.Write(append(buf, '\n')); err != nil {
+		return err
+	}
+	if err = cl.file.Sync(); err != nil {
+		return err
+	}
+
+	cl.size += int64(len(buf)+1)
+	cl.seq = entry.Seq
+	if cl.count == 0 {
+		cl.oldest = entry.Time
+	}
+	cl.count++
+
+	// truncating rewrites the file, so it only runs once the log has grown past its limit by half
+	if (cl.retention.MaxEntries > 0 && cl.count > cl.retention.MaxEntries + cl.retention.MaxEntries/2 + 1) ||
+	(cl.retention.MaxAge > 0 && cl.count > 1 && cl.oldest < entry.Time - (cl.retention.MaxAge * 3/2).Milliseconds()) {
+		return cl.truncate()
+	}
+
+	return nil
+}
+
+// load reads the number of entries, the oldest time, and the latest sequence number from the log file
+func (cl *changeLog) load() error {
+	stat, err := cl.file.Stat()
+	if err != nil {
+		return err
+	}
+
+	cl.count = 0
+	cl.oldest = 0
+	err = cl.each(0, func(entry ChangeLogEntry) bool {
+		if cl.count == 0 {
+			cl.oldest = entry.Time
+		}
+		cl.count++
+		cl.seq = entry.Seq
+		return true
+	})
+	if err != nil {
+		return err
+	}
+
+	cl.size = stat.Size()
+	return nil
+}
+
+// reload reads the log file again, if another process changed it since it was last written or read
+//
+// the database must hold a file lock, so the log cannot change while it is read
+func (cl *changeLog) reload() error {
+	stat, err := os.Stat(cl.path)
+	if err != nil {
+		return err
+	}
+	fileStat, err := cl.file.Stat()
+	if err != nil {
+		return err
+	}
+
+	if !os.SameFile(stat, fileStat) {
+		// another process replaced the file when it removed old entries
+		file, err := os.OpenFile(cl.path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0755)
+		if err != nil {
+			return err
+		}
+		cl.file.Close()
+		cl.file = file
+	}else if stat.Size() == cl.size {
+		return nil
+	}
+
+	// another process may have stopped part way through a write
+	if err := repairLog(cl.file); err != nil {
+		return err
+	}
+	return cl.load()
+}
+
+// repairLog removes a partly written line from the end of the log file, which is left behind if a write was interrupted
+//
+// otherwise the next entry would be appended to the end of it, and the combined line could never be read
+func repairLog(file *os.File) error {
+	stat, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	size := stat.Size()
+	buf := make([]byte, 4096)
+	end := size
+	for end > 0 {
+		start := end - int64(len(buf))
+		if start < 0 {
+			start = 0
+		}
+
+		n, err := file.ReadAt(buf[:end-start], start)
+		if err != nil && err != io.EOF {
+			return err
+		}
+
+		if i := bytes.LastIndexByte(buf[:n], '\n'); i != -1 {
+			end = start + int64(i) + 1
+			break
+		}
+		end = start
+	}
+
+	if end == size {
+		return nil
+	}
+	if err := file.Truncate(end); err != nil {
+		return err
+	}
+	return file.Sync()
+}
+
+// each reads the entries of the log file with a sequence number after afterSeq
+func (cl *changeLog) each(afterSeq uint64, each func(entry ChangeLogEntry) bool) error {
+	file, err := os.Open(cl.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return readLog(file, afterSeq, each)
+}
+
+// readLog reads the entries of a log file with a sequence number after afterSeq
+//
+// a partly written line at the end of the file is ignored
+func readLog(file io.Reader, afterSeq uint64, each func(entry ChangeLogEntry) bool) error {
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			return nil
+		}else if err != nil {
+			return err
+		}
+
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+
+		var entry ChangeLogEntry
+		if err := json.Unmarshal(line, &entry); err != nil {
+			return err
+		}
+
+		if entry.Seq > afterSeq && !each(entry) {
+			return nil
+		}
+	}
+}
+
+// truncate rewrites the log file with only the entries kept by the retention policy
+func (cl *changeLog) truncate() error {
+	entries := []ChangeLogEntry{}
+	err := cl.each(0, func(entry ChangeLogEntry) bool {
+		entries = append(entries, entry)
+		return true
+	})
+	if err != nil {
+		return err
+	}
+
+	start := 0
+	if cl.retention.MaxEntries > 0 && len(entries) > cl.retention.MaxEntries {
+		start = len(entries) - cl.retention.MaxEntries
+	}
+	if cl.retention.MaxAge > 0 {
+		minTime := time.Now().Add(-cl.retention.MaxAge).UnixMilli()
+		for start < len(entries) && entries[start].Time < minTime {
+			start++
+		}
+	}
+	if start >= len(entries) && len(entries) != 0 {
+		// keep the latest entry, so the sequence continues after a restart
+		start = len(entries)-1
+	}
+
+	if start == 0 {
+		return nil
+	}
+	entries = entries[start:]
+
+	// the new file is opened for appending, so it can replace the old one without being opened again
+	tmpPath := cl.path+".tmp"
+	file, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_RDWR|os.O_TRUNC|os.O_APPEND, 0755)
+	if err != nil {
+		return err
+	}
+
+	writer := bufio.NewWriter(file)
+	for _, entry := range entries {
+		buf, err := json.Marshal(entry)
+		if err != nil {
+			file.Close()
+			os.Remove(tmpPath)
+			return err
+		}
+		writer.Write(append(buf, '\n'))
+	}
+
+	if err := writer.Flush(); err != nil {
+		file.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+
+	// the old log is kept open until the new one is in place, so it is still used if the rename fails
+	if err := os.Rename(tmpPath, cl.path); err != nil {
+		file.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+
+	cl.file.Close()
+	cl.file = file
+
+	if stat, err := file.Stat(); err == nil {
+		cl.size = stat.Size()
+	}
+	cl.count = len(entries)
+	cl.oldest = entries[0].Time
+
+	return nil
+}
+
+// close closes the log file
+func (cl *changeLog) close() error {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+
+	return cl.file.Close()
+}
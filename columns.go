@@ -0,0 +1,398 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"strconv"
+	"unicode/utf8"
+
+	"github.com/AspieSoft/goutil/v7"
+)
+
+// ColumnType is the type of value a column can hold
+type ColumnType string
+
+const (
+	ColString ColumnType = "string"
+	ColInt ColumnType = "int"
+	ColFloat ColumnType = "float"
+	ColBool ColumnType = "bool"
+	ColBytes ColumnType = "bytes"
+)
+
+// Column is a named column in a table schema
+type Column struct {
+	Name string `json:"name"`
+	Type ColumnType `json:"type"`
+}
+
+// rowColumn is the stored value of a single column in a row
+type rowColumn struct {
+	name string
+	val []byte
+}
+
+// defaultColumn is the single column of a table without a schema
+var defaultColumn = Column{Name: "value", Type: ColString}
+
+// SetColumns declares the columns of the table
+//
+// the first column is used as the value of a row (Row.Value),
+// so tables without columns keep working as a table with a single "value" column
+//
+// columns are stored by name, so they can be added, removed, or reordered later,
+// and rows will keep the values of the columns that still exist
+//
+// rows that were added before the table had columns will use their value as the first column
+func (table *Table) SetColumns(columns []Column, noLock ...bool) error {
+	names := map[string]bool{}
+	for _, col := range columns {
+		if col.Name == "" {
+			return errors.New("column name cannot be empty")
+		}else if names[col.Name] {
+			return errors.New("duplicate column \""+col.Name+"\"")
+		}
+		names[col.Name] = true
+
+		switch col.Type {
+		case ColString, ColInt, ColFloat, ColBool, ColBytes:
+		default:
+			return errors.New("column \""+col.Name+"\" has an unknown type \""+string(col.Type)+"\"")
+		}
+	}
+
+	if len(noLock) == 0 || noLock[0] == false {
+		table.db.mu.Lock()
+		defer table.db.mu.Unlock()
+	}
+
+	if err := table.checkDeleted(); err != nil {
+		return err
+	}
+
+	table.meta.Columns = append([]Column{}, columns...)
+
+	table.db.file.Seek(table.line * int64(table.db.bitSize), io.SeekStart)
+	_, err := setDataObj(table.db, '$', table.key, table.encodeVal())
+	return table.db.syncWrite(err)
+}
+
+// Columns returns the columns of the table
+//
+// a table without columns will return a single "value" column
+func (table *Table) Columns() []Column {
+	if len(table.meta.Columns) == 0 {
+		return []Column{defaultColumn}
+	}
+	return append([]Column{}, table.meta.Columns...)
+}
+
+// AddRowColumns adds a new row to the table, with a value for each column
+//
+// columns that are not included will be empty
+func (table *Table) AddRowColumns(key string, values map[string]string, noLock ...bool) (*Row, error) {
+	return table.AddRowColumnsContext(context.Background(), key, values, noLock...)
+}
+
+// AddRowColumnsContext is the same as AddRowColumns, but gives up waiting for the database lock,
+// and stops scanning, once the context is done
+func (table *Table) AddRowColumnsContext(ctx context.Context, key string, values map[string]string, noLock ...bool) (*Row, error) {
+	keyB := goutil.Clean.Bytes([]byte(key))
+	keyB = bytes.TrimLeftFunc(keyB, func(r rune) bool {
+		return r == 0
+	})
+
+	if len(noLock) == 0 || noLock[0] == false {
+		if err := table.db.lockContext(ctx); err != nil {
+			return &Row{table: table}, err
+		}
+		defer table.db.mu.Unlock()
+	}
+
+	cols := []rowColumn{}
+	for _, col := range table.Columns() {
+		if val, ok := values[col.Name]; ok {
+			valB, err := col.parse([]byte(val))
+			if err != nil {
+				return &Row{table: table}, err
+			}
+			cols = append(cols, rowColumn{name: col.Name, val: valB})
+		}
+	}
+
+	for name := range values {
+		if columnIndex(table.Columns(), name) == -1 {
+			return &Row{table: table}, errors.New("column \""+name+"\" does not exist")
+		}
+	}
+
+	if len(table.meta.Columns) == 0 {
+		return table.addRow(ctx, keyB, encodeRowVal(rowHeader{}, columnValue(cols, defaultColumn.Name)), true)
+	}
+
+	return table.addRow(ctx, keyB, encodeRowVal(rowHeader{columns: true}, encodeColumns(cols)), true)
+}
+
+// Column returns the value of a column in the row
+func (row *Row) Column(name string) (string, error) {
+	if columnIndex(row.table.Columns(), name) == -1 {
+		return "", errors.New("column \""+name+"\" does not exist")
+	}
+
+	if row.cols == nil {
+		if name == row.table.firstColumn() {
+			return row.Value, nil
+		}
+		return "", nil
+	}
+
+	return string(row.column(name)), nil
+}
+
+// ColumnMap returns the value of every column in the row
+func (row *Row) ColumnMap() map[string]string {
+	res := map[string]string{}
+	for _, col := range row.table.Columns() {
+		val, _ := row.Column(col.Name)
+		res[col.Name] = val
+	}
+	return res
+}
+
+// SetColumn changes the value of a single column in the row
+//
+// the values of the other columns are kept exactly as they were stored
+func (row *Row) SetColumn(name string, value string, noLock ...bool) error {
+	return row.SetColumnContext(context.Background(), name, value, noLock...)
+}
+
+// SetColumnContext is the same as SetColumn, but gives up waiting for the database lock,
+// and stops scanning, once the context is done
+func (row *Row) SetColumnContext(ctx context.Context, name string, value string, noLock ...bool) error {
+	columns := row.table.Columns()
+	ind := columnIndex(columns, name)
+	if ind == -1 {
+		return errors.New("column \""+name+"\" does not exist")
+	}
+
+	valB, err := columns[ind].parse(goutil.Clean.Bytes([]byte(value)))
+	if err != nil {
+		return err
+	}
+
+	return row.setColumn(ctx, name, valB, nil, noLock...)
+}
+
+// setColumn changes the value of a single column without checking its type
+//
+// @expire replaces the expiry of the row (nil = keep the stored expiry)
+func (row *Row) setColumn(ctx context.Context, name string, valB []byte, expire *int64, noLock ...bool) error {
+	if len(row.table.meta.Columns) == 0 {
+		return row.setValueExpire(ctx, valB, expire, noLock...)
+	}
+
+	if len(noLock) == 0 || noLock[0] == false {
+		if err := row.table.db.lockContext(ctx); err != nil {
+			return err
+		}
+		defer row.table.db.mu.Unlock()
+	}
+
+	// another handle may have changed the row, so the column is merged into the stored row instead of this handle
+	current, err := row.stored(ctx)
+	if err != nil {
+		return err
+	}
+	row.Value = current.Value
+	row.header = current.header
+	row.cols = current.cols
+
+	cols := row.cols
+	if cols == nil {
+		// the row was added before the table had columns
+		cols = []rowColumn{{name: row.table.firstColumn(), val: []byte(row.Value)}}
+	}
+
+	newCols := make([]rowColumn, 0, len(cols)+1)
+	found := false
+	for _, col := range cols {
+		if col.name == name {
+			col.val = valB
+			found = true
+		}
+		newCols = append(newCols, col)
+	}
+	if !found {
+		newCols = append(newCols, rowColumn{name: name, val: valB})
+	}
+
+	// the schema only applies to the value of the row, which is the first column
+	newValue := columnValue(newCols, row.table.firstColumn())
+	if name == row.table.firstColumn() {
+		if err := row.table.validateValue(newValue); err != nil {
+			return err
+		}
+	}
+
+	if err := row.table.db.beforeWrite(Change{Op: OpSetRow, Table: row.table.Name, Key: row.Key, OldValue: row.Value, NewValue: string(newValue)}); err != nil {
+		return err
+	}
+
+	if err := row.pushHistory(); err != nil {
+		return err
+	}
+
+	oldCols := row.cols
+	oldHeader := row.header
+	row.cols = newCols
+	if expire != nil {
+		row.header.expire = *expire
+	}
+
+	keyB := goutil.Clean.Bytes([]byte(row.Key))
+	keyB = bytes.TrimLeftFunc(keyB, func(r rune) bool {
+		return r == 0
+	})
+
+	row.table.db.file.Seek(row.line * int64(row.table.db.bitSize), io.SeekStart)
+	if _, err := setDataObj(row.table.db, ':', keyB, row.encodeVal()); err != nil {
+		row.cols = oldCols
+		row.header = oldHeader
+		return err
+	}
+
+	oldValue := row.Value
+	row.Value = string(row.column(row.table.firstColumn()))
+
+	return row.table.db.syncWrite(row.table.db.notify(Change{Op: OpSetRow, Table: row.table.Name, Key: row.Key, OldValue: oldValue, NewValue: row.Value}))
+}
+
+// storedRowVal returns the data that should be stored for a new row with this value
+func (table *Table) storedRowVal(valB []byte, header rowHeader) ([]byte, error) {
+	if len(table.meta.Columns) == 0 {
+		header.columns = false
+		return encodeRowVal(header, valB), nil
+	}
+
+	valB, err := table.meta.Columns[0].parse(valB)
+	if err != nil {
+		return nil, err
+	}
+
+	header.columns = true
+	return encodeRowVal(header, encodeColumns([]rowColumn{{name: table.firstColumn(), val: valB}})), nil
+}
+
+// firstColumn returns the name of the column used as the value of a row
+func (table *Table) firstColumn() string {
+	if len(table.meta.Columns) == 0 {
+		return defaultColumn.Name
+	}
+	return table.meta.Columns[0].Name
+}
+
+// column returns the stored value of a column in the row
+func (row *Row) column(name string) []byte {
+	return columnValue(row.cols, name)
+}
+
+// parse checks that a value can be stored in the column
+func (col Column) parse(val []byte) ([]byte, error) {
+	var err error
+
+	switch col.Type {
+	case ColString:
+		if !utf8.Valid(val) {
+			err = errors.New("not a valid string")
+		}
+	case ColInt:
+		if len(val) != 0 {
+			_, err = strconv.ParseInt(string(val), 10, 64)
+		}
+	case ColFloat:
+		if len(val) != 0 {
+			_, err = strconv.ParseFloat(string(val), 64)
+		}
+	case ColBool:
+		if len(val) != 0 {
+			_, err = strconv.ParseBool(string(val))
+		}
+	}
+
+	if err != nil {
+		return nil, errors.New("column \""+col.Name+"\" expects a "+string(col.Type)+" value: "+err.Error())
+	}
+
+	return val, nil
+}
+
+func columnIndex(columns []Column, name string) int {
+	for i, col := range columns {
+		if col.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+func columnValue(cols []rowColumn, name string) []byte {
+	for _, col := range cols {
+		if col.name == name {
+			return col.val
+		}
+	}
+	return []byte{}
+}
+
+// encodeColumns encodes each column as "<name length>:<name><value length>:<value>", with base36 lengths
+func encodeColumns(cols []rowColumn) []byte {
+	res := []byte{}
+	for _, col := range cols {
+		res = append(res, strconv.FormatInt(int64(len(col.name)), 36)...)
+		res = append(res, ':')
+		res = append(res, col.name...)
+		res = append(res, strconv.FormatInt(int64(len(col.val)), 36)...)
+		res = append(res, ':')
+		res = append(res, col.val...)
+	}
+	return res
+}
+
+// decodeColumns decodes the columns stored by encodeColumns
+func decodeColumns(buf []byte) []rowColumn {
+	cols := []rowColumn{}
+
+	readPart := func() ([]byte, bool) {
+		i := bytes.IndexByte(buf, ':')
+		if i == -1 {
+			return nil, false
+		}
+
+		size, err := strconv.ParseInt(string(buf[:i]), 36, 64)
+		if err != nil || size < 0 || int64(len(buf)-i-1) < size {
+			return nil, false
+		}
+
+		part := buf[i+1:i+1+int(size)]
+		buf = buf[i+1+int(size):]
+		return part, true
+	}
+
+	for len(buf) != 0 {
+		name, ok := readPart()
+		if !ok {
+			break
+		}
+
+		val, ok := readPart()
+		if !ok {
+			break
+		}
+
+		cols = append(cols, rowColumn{name: string(name), val: val})
+	}
+
+	return cols
+}
@@ -0,0 +1,193 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"strconv"
+)
+
+// Count returns the number of rows in the table
+//
+// this method only reads the row list of the table, and does not decode any rows,
+// so rows that have expired, but have not been reaped yet, are still counted
+func (table *Table) Count(noLock ...bool) (int, error) {
+	if len(noLock) == 0 || noLock[0] == false {
+		table.db.mu.RLock()
+		defer table.db.mu.RUnlock()
+	}
+
+	if err := table.checkDeleted(); err != nil {
+		return 0, err
+	}
+
+	count := 0
+	rowList := bytes.Split(table.val, []byte{','})
+	for _, rowLine := range rowList {
+		if _, err := strconv.ParseInt(string(rowLine), 36, 64); err == nil {
+			count++
+		}
+	}
+
+	return count, nil
+}
+
+// CountMatch returns the number of rows in the table with a key accepted by the matcher
+//
+// unlike FindRowsMatch, this method only compares the keys, and does not build a list of rows
+//
+// note: a key is stored in the same encrypted block as its value,
+// so every row still has to be decrypted, unless the matcher is Any
+//
+// expired rows are not counted, unless the matcher is Any (see Count)
+func (table *Table) CountMatch(key Matcher, noLock ...bool) (int, error) {
+	return table.CountMatchContext(context.Background(), key, noLock...)
+}
+
+// CountMatchContext is the same as CountMatch, but gives up waiting for the database lock,
+// and stops scanning, once the context is done
+func (table *Table) CountMatchContext(ctx context.Context, key Matcher, noLock ...bool) (int, error) {
+	if key.err != nil {
+		return 0, key.err
+	}
+
+	if len(noLock) == 0 || noLock[0] == false {
+		if err := table.db.rlockContext(ctx); err != nil {
+			return 0, err
+		}
+		defer table.db.mu.RUnlock()
+	}
+
+	if err := table.checkDeleted(); err != nil {
+		return 0, err
+	}
+
+	if key.kind == matchAny {
+		return table.Count(true)
+	}
+
+	count := 0
+	rowList := bytes.Split(table.val, []byte{','})
+	for _, rowLine := range rowList {
+		if err := ctx.Err(); err != nil {
+			return count, err
+		}
+
+		if line, err := strconv.ParseInt(string(rowLine), 36, 64); err == nil {
+			table.db.file.Seek(line * int64(table.db.bitSize), io.SeekStart)
+			if _, err := scanDataObj(ctx, table.db, ':', table.rowMatch(func(k, v []byte) bool {
+				return key.Match(k)
+			}), true); err == nil {
+				count++
+			}
+		}
+	}
+
+	return count, nil
+}
+
+// TableCount returns the number of tables in the database
+//
+// the first call has to check the prefix of every object in the database,
+// after that, the count is kept up to date as tables are added and removed
+func (db *Database) TableCount(noLock ...bool) (int, error) {
+	if len(noLock) == 0 || noLock[0] == false {
+		db.mu.RLock()
+		defer db.mu.RUnlock()
+	}
+
+	if db.tableCount == -1 {
+		count, err := countPrefix(db, '$')
+		if err != nil {
+			return 0, err
+		}
+		db.tableCount = count
+	}
+
+	return int(db.tableCount), nil
+}
+
+// DataCount returns the number of key value pairs in the database
+//
+// the first call has to check the prefix of every object in the database,
+// after that, the count is kept up to date as data is added and removed
+func (db *Database) DataCount(noLock ...bool) (int, error) {
+	if len(noLock) == 0 || noLock[0] == false {
+		db.mu.RLock()
+		defer db.mu.RUnlock()
+	}
+
+	if db.dataCount == -1 {
+		count, err := countPrefix(db, '~')
+		if err != nil {
+			return 0, err
+		}
+		db.dataCount = count
+	}
+
+	return int(db.dataCount), nil
+}
+
+// DataCountMatch returns the number of key value pairs with a key accepted by the matcher
+//
+// note: a key is stored in the same encrypted block as its value,
+// so every pair still has to be decrypted, unless the matcher is Any
+func (db *Database) DataCountMatch(key Matcher, noLock ...bool) (int, error) {
+	return db.DataCountMatchContext(context.Background(), key, noLock...)
+}
+
+// DataCountMatchContext is the same as DataCountMatch, but gives up waiting for the database lock,
+// and stops scanning, once the context is done
+func (db *Database) DataCountMatchContext(ctx context.Context, key Matcher, noLock ...bool) (int, error) {
+	if key.err != nil {
+		return 0, key.err
+	}
+
+	if len(noLock) == 0 || noLock[0] == false {
+		if err := db.rlockContext(ctx); err != nil {
+			return 0, err
+		}
+		defer db.mu.RUnlock()
+	}
+
+	if key.kind == matchAny {
+		return db.DataCount(true)
+	}
+
+	count := 0
+	db.file.Seek(0, io.SeekStart)
+	for {
+		_, err := scanDataObj(ctx, db, '~', func(k, v []byte) bool {
+			return key.Match(k)
+		})
+		if err == context.Canceled || err == context.DeadlineExceeded {
+			return count, err
+		}else if err != nil {
+			break
+		}
+		count++
+	}
+
+	return count, nil
+}
+
+// countPrefix counts the objects in the database that start with a prefix, without decoding them
+func countPrefix(db *Database, prefix byte) (int64, error) {
+	var count int64
+
+	buf := make([]byte, 1)
+	for pos := int64(db.bitSize); ; pos += int64(db.bitSize) {
+		_, err := db.file.ReadAt(buf, pos)
+		if err == io.EOF {
+			break
+		}else if err != nil {
+			return 0, err
+		}
+
+		if buf[0] == prefix {
+			count++
+		}
+	}
+
+	return count, nil
+}
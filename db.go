@@ -2,6 +2,7 @@ package db
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"io"
 	"os"
@@ -16,19 +17,62 @@ import (
 	"github.com/cespare/go-smaz"
 )
 
+// DebugMode is the default for WithTextLayout, and disables compression by default
+//
+// it is only read when a new file is created, since the layout of a file is stored in its header
+//
+// Deprecated: use WithTextLayout and WithCompression instead
 var DebugMode = false
 
 const coreChars = "%=,@#!-\n"
 const maxDatabaseSize uint64 = 99999999999999 // 14 (64000 bit - max lines = 1 billion)
 
 type Database struct {
-	file *os.File
+	file dbFile
 	path string
+
+	// storage holds the blocks that file reads and writes
+	storage Storage
+
+	// customStorage is true if the storage was chosen with WithStorage, instead of opened from the path
+	customStorage bool
+
 	bitSize uint16
 	prefixList []byte
 	cache *haxmap.Map[string, *Table]
-	mu sync.Mutex
+	mu dbMutex
 	encKey []byte
+
+	// the number of tables and data objects, or -1 if they have not been counted yet
+	tableCount int64
+	dataCount int64
+
+	// the generation of each line that has been freed, so handles to a freed line can be detected
+	//
+	// lines that are not in the map use minGen, which is raised when every handle becomes stale (i.e. Optimize)
+	gens map[int64]uint64
+	genCount uint64
+	minGen uint64
+
+	watchMu sync.Mutex
+	watchers map[*watcher]bool
+
+	// changeLog stores every change in a file, once EnableChangeLog is called
+	changeLog *changeLog
+
+	hooks hookList
+
+	// readOnly is true for a Snapshot, or a database opened with ModeReadOnly
+	readOnly bool
+	mode OpenMode
+
+	// settings from the options passed to Open
+	compress bool
+	textLayout bool
+	syncPolicy SyncPolicy
+
+	// changeCount is the change counter of the file header, as of the last time this process read or wrote it
+	changeCount uint64
 }
 
 type dbObj struct {
@@ -41,101 +85,233 @@ type dbObj struct {
 }
 
 
+// ErrLocked is returned by Open when another process holds a lock that conflicts with the mode
+var ErrLocked = errors.New("database is locked by another process")
+
+// OpenMode controls how a database file is opened, and how it is shared with other processes
+type OpenMode uint8
+
+const (
+	// ModeReadWrite opens the database for reading and writing, without an advisory lock (the default for Open)
+	ModeReadWrite OpenMode = iota
+
+	// ModeReadOnly opens an existing database for reading, with a shared advisory lock
+	//
+	// writes return ErrReadOnly, and opening fails with ErrLocked while another process holds the writer lock
+	ModeReadOnly
+
+	// ModeExclusive opens the database for reading and writing, with an exclusive advisory lock,
+	// which is held until the database is closed
+	//
+	// opening fails with ErrLocked while another process has the database open with a lock
+	ModeExclusive
+
+	// ModeShared opens the database for reading and writing, so it can be used by many processes at the same time
+	//
+	// each operation waits for an advisory lock on the file, which is a shared lock for reads, and an exclusive lock for writes,
+	// and changes made by other processes are noticed when the lock is taken
+	//
+	// after another process writes, Row and Data handles return ErrStaleHandle, and need to be retrieved again
+	//
+	// while another process holds a lock with ModeReadOnly or ModeExclusive, operations wait for it to close the database
+	//
+	// note: snapshots are not isolated from writes made by other processes, and Optimize cannot be used in this mode
+	ModeShared
+)
+
 // Open opens an existing database or creates a new one
 //
-// @bitSize tells the database what bit size to use (this value must always be consistent)
-//  - (default: 128)
-//  - (0 = default 128)
-//  - (min = 64)
-//  - (max = 64000)
-// note: in debug mode, (min = 16)
-func Open(path string, encKey []byte, bitSize ...uint16) (*Database, error) {
-	path, err := filepath.Abs(path)
-	if err != nil {
-		return &Database{}, err
+// @opts change the settings of the database (i.e. WithKey, WithBitSize, WithReadOnly)
+//
+// each database keeps its own settings, so databases with different settings can be open at the same time
+func Open(path string, opts ...Option) (*Database, error) {
+	o := newOptions()
+	for _, opt := range opts {
+		opt(&o)
 	}
+	encKey, mode, storage := o.encKey, o.mode, o.storage
 
-	path = string(regex.Comp(`[\\/]+$`).RepStr([]byte(path), []byte{}))
-	if !strings.HasSuffix(path, ".db") {
-		path += ".db"
+	// a database with its own storage does not need a path, but it is still used for the change log
+	var err error
+	if storage == nil || path != "" {
+		path, err = filepath.Abs(path)
+		if err != nil {
+			return &Database{}, err
+		}
+
+		path = string(regex.Comp(`[\\/]+$`).RepStr([]byte(path), []byte{}))
+		if !strings.HasSuffix(path, ".db") {
+			path += ".db"
+		}
 	}
 
-	os.MkdirAll(string(regex.Comp(`[\\/][^\\/]+$`).RepStr([]byte(path), []byte{})), 0755)
+	var file *os.File
+	if storage == nil {
+		if mode == ModeReadOnly {
+			file, err = os.OpenFile(path, os.O_RDONLY, 0)
+		}else{
+			os.MkdirAll(string(regex.Comp(`[\\/][^\\/]+$`).RepStr([]byte(path), []byte{})), 0755)
+			file, err = os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0755)
+		}
+		if err != nil {
+			return &Database{}, err
+		}
+		storage = FileStorage{file}
+	}else if fs, ok := storage.(FileStorage); ok {
+		file = fs.File
+	}
 
-	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0755)
-	if err != nil {
-		return &Database{}, err
+	opened := false
+	defer func(){
+		if !opened {
+			storage.Close()
+		}
+	}()
+
+	if file == nil {
+		if mode == ModeExclusive || mode == ModeShared {
+			return &Database{}, errors.New("file locks can only be used with a FileStorage")
+		}
+	}else if mode == ModeReadOnly || mode == ModeExclusive {
+		if err := lockFile(file, mode == ModeExclusive, false); err != nil {
+			return &Database{}, err
+		}
+	}else if mode == ModeShared {
+		// another process may be creating the database at the same time
+		if err := lockFile(file, true, true); err != nil {
+			return &Database{}, err
+		}
+		defer unlockFile(file)
 	}
 
 	newFile := false
-	if _, err = file.ReadAt(make([]byte, 1), 0); err == io.EOF {
+	if _, err = storage.ReadAt(make([]byte, 1), 0); err == io.EOF {
 		newFile = true
 	}
 
-	bSize := uint16(0)
-	if len(bitSize) != 0 {
-		bSize = bitSize[0]
-	}
-
+	bSize := o.bitSize
 	if bSize == 0 {
 		bSize = 128
-	}else if DebugMode && bSize < 16 {
+	}else if o.textLayout && bSize < 16 {
 		bSize = 16
-	}else if !DebugMode && bSize < 64 {
+	}else if !o.textLayout && bSize < 64 {
 		bSize = 64
 	}else if bSize > 64000 {
 		bSize = 64000
 	}
 
 	db := &Database{
-		file: file,
+		file: &cowFile{dbFile: &storageFile{Storage: storage}},
+		storage: storage,
+		customStorage: o.storage != nil,
 		path: path,
 		bitSize: 10,
-		prefixList: []byte("$:~"),
+		prefixList: []byte("$:~^"),
 		cache: haxmap.New[string, *Table](),
 		encKey: encKey,
+		tableCount: -1,
+		dataCount: -1,
+		gens: map[int64]uint64{},
+		mode: mode,
+		readOnly: mode == ModeReadOnly,
+		compress: o.compress,
+		textLayout: o.textLayout,
+		syncPolicy: o.syncPolicy,
 	}
+	db.mu.db = db
 
-	if newFile {
+	if newFile && mode == ModeReadOnly {
+		return &Database{}, errors.New("cannot open an empty database in read only mode")
+	}else if newFile {
 		db.bitSize = bSize
 		s := strconv.FormatUint(uint64(bSize), 36)
-		sp := int(bSize - 5) - len(s)
-		if DebugMode {
+		sp := int(bSize) - layoutFlagPos - 1
+		if db.textLayout {
 			sp--
 		}
-		if sp < 0 || len(s) > 5 {
+		if sp < 0 || len(s) > layoutFlagPos - 5 {
 			return &Database{}, errors.New("bit size too large") // user specified bit for a new database
 		}
 
-		file.WriteAt([]byte("#bit="+s+strings.Repeat("-", sp)), 0)
-		if DebugMode {
-			file.WriteAt([]byte{'\n'}, int64(bSize-1))
+		// the layout is stored in the header, so the file can be opened with any options
+		header := "#bit="+s+strings.Repeat("-", layoutFlagPos - 5 - len(s))
+		header += string(layoutFlag(db.textLayout, db.compress))
+		storage.WriteAt([]byte(header+strings.Repeat("-", sp)), 0)
+		if db.textLayout {
+			storage.WriteAt([]byte{'\n'}, int64(bSize-1))
 		}
 
 		addDataObj(db, '#', []byte("enc"), []byte("enc"))
 	}else{
 		buf := make([]byte, 10)
-		_, err = file.ReadAt(buf, 0)
+		_, err = storage.ReadAt(buf, 0)
 		if err != nil || !bytes.HasPrefix(buf, []byte("#bit=")) {
 			return &Database{}, errors.New("defined bit size too large") // current bit size defined by the database file
 		}
 
-		if i, err := strconv.ParseUint(string(bytes.TrimRight(buf[5:], "-")), 36, 16); err == nil && i != 0 {
+		if i, err := strconv.ParseUint(string(bytes.TrimRight(buf[5:layoutFlagPos], "-")), 36, 16); err == nil && i != 0 {
 			bSize = uint16(i)
 		}else{
 			return &Database{}, errors.New("defined bit size is NaN:36 (not a base36 number)") // current bit size defined by the database file
 		}
 		db.bitSize = bSize
 
-		file.Seek(int64(bSize), io.SeekStart)
+		// the layout of the file is used, instead of the options
+		end := make([]byte, 1)
+		storage.ReadAt(end, int64(bSize-1))
+		if textLayout, compress, ok := parseLayoutFlag(buf[layoutFlagPos], end[0] == '\n'); ok {
+			db.textLayout = textLayout
+			db.compress = compress
+		}else{
+			return &Database{}, errors.New("unknown file layout") // current layout defined by the database file
+		}
+
+		db.file.Seek(int64(bSize), io.SeekStart)
 		if encData, err := getDataObj(db, '#', []byte("enc"), []byte{0}); err != nil || !bytes.Equal(encData.val, []byte("enc")) {
 			return &Database{}, errors.New("failed to decrypt database")
 		}
 	}
 
+	if mode == ModeShared {
+		db.mu.file = file
+		db.changeCount = db.readChangeCount()
+	}
+
+	opened = true
 	return db, nil
 }
 
+// lockContext waits for the database lock, and gives up with ctx.Err() once the context is done
+func (db *Database) lockContext(ctx context.Context) error {
+	return db.mu.lockContext(ctx, true)
+}
+
+// rlockContext is the same as lockContext, but only takes a shared file lock for ModeShared, so the operation must not write
+func (db *Database) rlockContext(ctx context.Context) error {
+	return db.mu.lockContext(ctx, false)
+}
+
+// lineGen returns the current generation of a line
+//
+// a handle stores the generation of its line when it is created,
+// and the generation changes every time the line is freed
+func (db *Database) lineGen(line int64) uint64 {
+	if gen := db.gens[line]; gen > db.minGen {
+		return gen
+	}
+	return db.minGen
+}
+
+// freeLine changes the generation of a line, so existing handles to it become stale
+func (db *Database) freeLine(line int64) {
+	if db.gens == nil {
+		db.gens = map[int64]uint64{}
+	}
+
+	db.genCount++
+	db.gens[line] = db.genCount
+}
+
 // Close closes the database file
 func (db *Database) Close() error {
 	db.mu.Lock()
@@ -144,6 +320,10 @@ func (db *Database) Close() error {
 	err1 := db.file.Sync()
 	err2 := db.file.Close()
 
+	if db.changeLog != nil {
+		db.changeLog.close()
+	}
+
 	if err2 == nil {
 		return err1
 	}
@@ -159,6 +339,10 @@ func (db *Database) Close() error {
 
 
 func addDataObj(db *Database, prefix byte, key []byte, val []byte) (dbObj, error) {
+	if err := db.checkWritable(); err != nil {
+		return dbObj{}, err
+	}
+
 	pos, _ := db.file.Seek(0, io.SeekStart)
 
 	if off := pos % int64(db.bitSize); off != 0 {
@@ -200,7 +384,7 @@ func addDataObj(db *Database, prefix byte, key []byte, val []byte) (dbObj, error
 	db.file.Write([]byte{prefix})
 
 	off := 1
-	if DebugMode {
+	if db.textLayout {
 		off++
 	}
 
@@ -241,7 +425,7 @@ func addDataObj(db *Database, prefix byte, key []byte, val []byte) (dbObj, error
 		posStr = append([]byte{'@'}, posStr...)
 		offset := int(db.bitSize) - len(posStr) - 1
 
-		if DebugMode {
+		if db.textLayout {
 			offset--
 		}
 
@@ -249,7 +433,7 @@ func addDataObj(db *Database, prefix byte, key []byte, val []byte) (dbObj, error
 		db.file.Write(posStr)
 		val = val[offset:]
 
-		if DebugMode {
+		if db.textLayout {
 			db.file.Write([]byte{'\n'})
 		}
 
@@ -262,7 +446,7 @@ func addDataObj(db *Database, prefix byte, key []byte, val []byte) (dbObj, error
 
 	db.file.Write(val)
 	if len(val) < int(db.bitSize) {
-		if DebugMode {
+		if db.textLayout {
 			db.file.Write(bytes.Repeat([]byte{'-'}, int(db.bitSize) - len(val) - 2))
 			db.file.Write([]byte{'\n'})
 		}else{
@@ -274,53 +458,31 @@ func addDataObj(db *Database, prefix byte, key []byte, val []byte) (dbObj, error
 }
 
 func getDataObj(db *Database, prefix byte, key []byte, val []byte, stopAfterFirstRow ...bool) (dbObj, error) {
-	regTypeKey := uint8(0)
-	regTypeVal := uint8(0)
-	var reKey *regex.Regexp
-	var reVal *regex.Regexp
-	var err error
+	return getDataObjCtx(context.Background(), db, prefix, key, val, stopAfterFirstRow...)
+}
 
-	var encErr error
+// getDataObjCtx is the same as getDataObj, but stops scanning and returns ctx.Err() once the context is done
+func getDataObjCtx(ctx context.Context, db *Database, prefix byte, key []byte, val []byte, stopAfterFirstRow ...bool) (dbObj, error) {
+	return matchDataObj(ctx, db, prefix, legacyMatcher(key), legacyMatcher(val), stopAfterFirstRow...)
+}
 
-	if len(key) != 0 && key[0] == 0 {
-		regTypeKey = 1
-		key = key[1:]
-
-		if len(key) == 1 && key[0] == '*' {
-			regTypeKey = 2
-		}else if len(key) != 0 {
-			regTypeKey = 3
-			reKey, err = regex.CompTry(string(regex.Comp(`(\\*)([\\\%])`).RepFunc(key, func(data func(int) []byte) []byte {
-				if l := len(data(1)); (l == 0 || l % 2 == 0) && data(2)[0] != '\\' {
-					return regex.JoinBytes(data(1), '\\', data(2))
-				}
-				return data(0)
-			})))
-			if err != nil {
-				return dbObj{}, err
-			}
-		}
+// matchDataObj finds the next object with a key and value accepted by the matchers
+func matchDataObj(ctx context.Context, db *Database, prefix byte, key Matcher, val Matcher, stopAfterFirstRow ...bool) (dbObj, error) {
+	if key.err != nil {
+		return dbObj{}, key.err
+	}else if val.err != nil {
+		return dbObj{}, val.err
 	}
 
-	if len(val) != 0 && val[0] == 0 {
-		regTypeVal = 1
-		val = val[1:]
+	return scanDataObj(ctx, db, prefix, func(k, v []byte) bool {
+		return key.Match(k) && val.Match(v)
+	}, stopAfterFirstRow...)
+}
 
-		if len(val) == 1 && val[0] == '*' {
-			regTypeVal = 2
-		}else if len(val) != 0 {
-			regTypeVal = 3
-			reVal, err = regex.CompTry(string(regex.Comp(`(\\*)([\\\%])`).RepFunc(val, func(data func(int) []byte) []byte {
-				if l := len(data(1)); (l == 0 || l % 2 == 0) && data(2)[0] != '\\' {
-					return regex.JoinBytes(data(1), '\\', data(2))
-				}
-				return data(0)
-			})))
-			if err != nil {
-				return dbObj{}, err
-			}
-		}
-	}
+// scanDataObj finds the next object with a key and value accepted by the match function
+func scanDataObj(ctx context.Context, db *Database, prefix byte, match func(key []byte, val []byte) bool, stopAfterFirstRow ...bool) (dbObj, error) {
+	var err error
+	var encErr error
 
 	stopFirstRow := false
 	if len(stopAfterFirstRow) != 0 && stopAfterFirstRow[0] == true {
@@ -338,6 +500,10 @@ func getDataObj(db *Database, prefix byte, key []byte, val []byte, stopAfterFirs
 	_, err = db.file.Read(buf)
 
 	for err == nil /* && buf[0] != prefix */ {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return dbObj{}, ctxErr
+		}
+
 		if buf[0] == prefix {
 			buf = make([]byte, int64(db.bitSize)-1)
 			_, err = db.file.Read(buf)
@@ -360,7 +526,7 @@ func getDataObj(db *Database, prefix byte, key []byte, val []byte, stopAfterFirs
 
 			buf, encErr = decData(db, buf)
 			if encErr != nil {
-				db.file.Seek(pos + int64(db.bitSize), io.SeekStart)
+				pos, _ = db.file.Seek(pos + int64(db.bitSize), io.SeekStart)
 				buf = make([]byte, 1)
 				_, err = db.file.Read(buf)
 
@@ -374,7 +540,7 @@ func getDataObj(db *Database, prefix byte, key []byte, val []byte, stopAfterFirs
 
 			data := bytes.SplitN(buf, []byte{'='}, 2)
 			if len(data) == 0 {
-				db.file.Seek(pos + int64(db.bitSize), io.SeekStart)
+				pos, _ = db.file.Seek(pos + int64(db.bitSize), io.SeekStart)
 				buf = make([]byte, 1)
 				_, err = db.file.Read(buf)
 
@@ -392,24 +558,20 @@ func getDataObj(db *Database, prefix byte, key []byte, val []byte, stopAfterFirs
 				data = append(data, []byte{})
 			}
 
-			if (regTypeKey == 0 && bytes.Equal(key, data[0])) || regTypeKey == 1 || regTypeKey == 2 ||
-			(regTypeKey == 3 && reKey.Match(data[0])) {
-				if (regTypeVal == 0 && bytes.Equal(val, data[1])) || regTypeVal == 1 || regTypeVal == 2 ||
-				(regTypeVal == 3 && reVal.Match(data[1])) {
-					db.file.Seek(pos + int64(db.bitSize), io.SeekStart)
-
-					obj := dbObj{
-						key: data[0],
-						val: data[1],
-						line: pos / int64(db.bitSize),
-					}
+			if match(data[0], data[1]) {
+				db.file.Seek(pos + int64(db.bitSize), io.SeekStart)
 
-					if encErr != nil {
-						return obj, encErr
-					}
+				obj := dbObj{
+					key: data[0],
+					val: data[1],
+					line: pos / int64(db.bitSize),
+				}
 
-					return obj, nil
+				if encErr != nil {
+					return obj, encErr
 				}
+
+				return obj, nil
 			}
 
 			if stopFirstRow {
@@ -419,7 +581,7 @@ func getDataObj(db *Database, prefix byte, key []byte, val []byte, stopAfterFirs
 				return dbObj{}, io.EOF
 			}
 
-			db.file.Seek(pos + int64(db.bitSize), io.SeekStart)
+			pos, _ = db.file.Seek(pos + int64(db.bitSize), io.SeekStart)
 			buf = make([]byte, 1)
 			_, err = db.file.Read(buf)
 			continue
@@ -439,6 +601,10 @@ func getDataObj(db *Database, prefix byte, key []byte, val []byte, stopAfterFirs
 }
 
 func delDataObj(db *Database, prefix byte) (dbObj, error) {
+	if err := db.checkWritable(); err != nil {
+		return dbObj{}, err
+	}
+
 	pos, _ := db.file.Seek(0, io.SeekCurrent)
 
 	if off := pos % int64(db.bitSize); off != 0 {
@@ -463,7 +629,7 @@ func delDataObj(db *Database, prefix byte) (dbObj, error) {
 
 	db.file.Seek(int64(db.bitSize) * -1, io.SeekCurrent)
 	db.file.Write([]byte{'!'})
-	if DebugMode {
+	if db.textLayout {
 		db.file.Write(bytes.Repeat([]byte{'-'}, int(db.bitSize)-2))
 		db.file.Write([]byte{'\n'})
 	}else{
@@ -481,7 +647,7 @@ func delDataObj(db *Database, prefix byte) (dbObj, error) {
 				if err == nil && b[0] == '&' {
 					db.file.Seek(int64(db.bitSize) * -1, io.SeekCurrent)
 					db.file.Write([]byte{'!'})
-					if DebugMode {
+					if db.textLayout {
 						db.file.Write(bytes.Repeat([]byte{'-'}, int(db.bitSize)-2))
 						db.file.Write([]byte{'\n'})
 					}else{
@@ -502,6 +668,8 @@ func delDataObj(db *Database, prefix byte) (dbObj, error) {
 
 	db.file.Seek(pos + int64(db.bitSize), io.SeekStart)
 
+	db.freeLine(pos / int64(db.bitSize))
+
 	return dbObj{
 		key: data[0],
 		val: data[1],
@@ -510,6 +678,10 @@ func delDataObj(db *Database, prefix byte) (dbObj, error) {
 }
 
 func setDataObj(db *Database, prefix byte, key []byte, val []byte) (dbObj, error) {
+	if err := db.checkWritable(); err != nil {
+		return dbObj{}, err
+	}
+
 	pos, _ := db.file.Seek(0, io.SeekCurrent)
 
 	if off := pos % int64(db.bitSize); off != 0 {
@@ -546,7 +718,7 @@ func setDataObj(db *Database, prefix byte, key []byte, val []byte) (dbObj, error
 
 	// set data
 	off := 1
-	if DebugMode {
+	if db.textLayout {
 		off++
 	}
 
@@ -566,7 +738,7 @@ func setDataObj(db *Database, prefix byte, key []byte, val []byte) (dbObj, error
 					if len(val) == 0 {
 						db.file.Seek(oldPos, io.SeekStart)
 						db.file.Write([]byte{'!'})
-						if DebugMode {
+						if db.textLayout {
 							db.file.Write(bytes.Repeat([]byte{'-'}, int(db.bitSize)-2))
 							db.file.Write([]byte{'\n'})
 						}else{
@@ -581,7 +753,7 @@ func setDataObj(db *Database, prefix byte, key []byte, val []byte) (dbObj, error
 							posStr = append([]byte{'@'}, posStr...)
 							offset := int(db.bitSize) - len(posStr) - 1
 
-							if DebugMode {
+							if db.textLayout {
 								offset--
 							}
 
@@ -589,13 +761,13 @@ func setDataObj(db *Database, prefix byte, key []byte, val []byte) (dbObj, error
 							db.file.Write(posStr)
 							val = val[offset:]
 
-							if DebugMode {
+							if db.textLayout {
 								db.file.Write([]byte{'\n'})
 							}
 						}else{
 							db.file.Write(val)
 							if len(val) < int(db.bitSize) {
-								if DebugMode {
+								if db.textLayout {
 									db.file.Write(bytes.Repeat([]byte{'-'}, int(db.bitSize) - len(val) - 2))
 									db.file.Write([]byte{'\n'})
 								}else{
@@ -632,7 +804,7 @@ func setDataObj(db *Database, prefix byte, key []byte, val []byte) (dbObj, error
 		if len(val) == 0 {
 			db.file.Seek(oldPos, io.SeekStart)
 			db.file.Write([]byte{'!'})
-			if DebugMode {
+			if db.textLayout {
 				db.file.Write(bytes.Repeat([]byte{'-'}, int(db.bitSize)-2))
 				db.file.Write([]byte{'\n'})
 			}else{
@@ -677,7 +849,7 @@ func setDataObj(db *Database, prefix byte, key []byte, val []byte) (dbObj, error
 				posStr = append([]byte{'@'}, posStr...)
 				offset := int(db.bitSize) - len(posStr) - 1
 
-				if DebugMode {
+				if db.textLayout {
 					offset--
 				}
 
@@ -685,7 +857,7 @@ func setDataObj(db *Database, prefix byte, key []byte, val []byte) (dbObj, error
 				db.file.Write(posStr)
 				val = val[offset:]
 
-				if DebugMode {
+				if db.textLayout {
 					db.file.Write([]byte{'\n'})
 				}
 
@@ -732,7 +904,7 @@ func setDataObj(db *Database, prefix byte, key []byte, val []byte) (dbObj, error
 					posStr = append([]byte{'@'}, posStr...)
 					offset := int(db.bitSize) - len(posStr) - 1
 			
-					if DebugMode {
+					if db.textLayout {
 						offset--
 					}
 			
@@ -740,7 +912,7 @@ func setDataObj(db *Database, prefix byte, key []byte, val []byte) (dbObj, error
 					db.file.Write(posStr)
 					val = val[offset:]
 			
-					if DebugMode {
+					if db.textLayout {
 						db.file.Write([]byte{'\n'})
 					}
 			
@@ -753,7 +925,7 @@ func setDataObj(db *Database, prefix byte, key []byte, val []byte) (dbObj, error
 
 				db.file.Write(val)
 				if len(val) < int(db.bitSize) {
-					if DebugMode {
+					if db.textLayout {
 						db.file.Write(bytes.Repeat([]byte{'-'}, int(db.bitSize) - len(val) - 2))
 						db.file.Write([]byte{'\n'})
 					}else{
@@ -763,7 +935,7 @@ func setDataObj(db *Database, prefix byte, key []byte, val []byte) (dbObj, error
 			}else{
 				db.file.Write(val)
 				if len(val) < int(db.bitSize) {
-					if DebugMode {
+					if db.textLayout {
 						db.file.Write(bytes.Repeat([]byte{'-'}, int(db.bitSize) - len(val) - 2))
 						db.file.Write([]byte{'\n'})
 					}else{
@@ -786,7 +958,7 @@ func encData(db *Database, buf []byte) ([]byte, error) {
 		if err != nil {
 			return nil, err
 		}
-	}else if !DebugMode {
+	}else if db.compress {
 		buf = smaz.Compress(buf)
 	}
 
@@ -844,7 +1016,7 @@ func decData(db *Database, buf []byte) ([]byte, error) {
 			return nil, errors.New("failed to decrypt")
 		}
 		buf = buf[:len(buf)-4]
-	}else if !DebugMode {
+	}else if db.compress {
 		buf, err = smaz.Decompress(buf)
 		if err != nil {
 			return nil, err
@@ -1,19 +1,26 @@
 package db
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"os"
+	"runtime"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 )
 
 func Test(t *testing.T){
-	DebugMode = true
 	_ = fmt.Println
 
 	os.Remove("test/test.db")
 
-	db, err := Open("test/test.db", []byte("key123"), 16)
+	db, err := Open("test/test.db", WithKey([]byte("key123")), WithTextLayout(true), WithBitSize(16))
 	if err != nil {
 		t.Error(err)
 	}
@@ -60,12 +67,11 @@ func Test(t *testing.T){
 }
 
 func TestCore(t *testing.T){
-	DebugMode = true
 	_ = fmt.Println
 
 	os.Remove("test/core.db")
 
-	db, err := Open("test/core.db", nil, 16)
+	db, err := Open("test/core.db", WithTextLayout(true), WithBitSize(16))
 	if err != nil {
 		t.Error(err)
 	}
@@ -90,3 +96,2010 @@ func TestCore(t *testing.T){
 	// setDataObj(db, '$', []byte("MyTable"), []byte("MyVal_MoreTextToMakeThisLonger"))
 	// setDataObj(db, '$', []byte("MyTable"), []byte("MyVal_MoreTextToMakeThisLonger_MoreTextToMakeThisLonger"))
 }
+
+func TestContext(t *testing.T){
+	os.Remove("test/context.db")
+
+	db, err := Open("test/context.db", WithTextLayout(true), WithBitSize(16))
+	if err != nil {
+		t.Error(err)
+	}
+	defer db.Close()
+
+	table, err := db.AddTable("MyTable")
+	if err != nil {
+		t.Error(err)
+	}
+
+	_, err = table.AddRow("Row1", "val1")
+	if err != nil {
+		t.Error(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, err = table.FindRowsContext(ctx, []byte{0}, []byte{0}); err != context.Canceled {
+		t.Error("expected canceled context, got:", err)
+	}
+
+	// lock timeout
+	db.mu.Lock()
+	ctx, cancel = context.WithTimeout(context.Background(), 10 * time.Millisecond)
+	defer cancel()
+	if _, err = db.GetTableContext(ctx, "MyTable"); err != context.DeadlineExceeded {
+		t.Error("expected deadline exceeded, got:", err)
+	}
+
+	// giving up does not leave anything behind that still waits for the lock
+	goroutines := runtime.NumGoroutine()
+	for i := 0; i < 10; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+		db.AddTableContext(ctx, "Other")
+		cancel()
+	}
+	if n := runtime.NumGoroutine(); n > goroutines {
+		t.Error("expected no goroutines to wait for the lock, got", n - goroutines)
+	}
+	db.mu.Unlock()
+
+	if _, err = table.GetRow("Row1"); err != nil {
+		t.Error(err)
+	}
+
+	// a scan that is canceled part way through never adds a duplicate
+	for i := 0; i < 10; i++ {
+		db.AddTable("Table"+strconv.Itoa(i))
+		table.AddRow("Row"+strconv.Itoa(i+2), "val")
+		db.AddData("Data"+strconv.Itoa(i), "val")
+	}
+	for n := 0; n < 100; n++ {
+		if _, err = db.AddTableContext(&cancelAfter{context.Background(), n}, "Table9"); err == nil {
+			t.Error("expected AddTable to fail after", n, "checks")
+		}
+		if _, err = table.AddRowContext(&cancelAfter{context.Background(), n}, "Row11", "val"); err == nil {
+			t.Error("expected AddRow to fail after", n, "checks")
+		}
+		if _, err = db.AddDataContext(&cancelAfter{context.Background(), n}, "Data9", "val"); err == nil {
+			t.Error("expected AddData to fail after", n, "checks")
+		}
+	}
+	if n, _ := db.TableCount(); n != 11 {
+		t.Error("expected 11 tables, got", n)
+	}
+	if n, _ := table.CountMatch(Any()); n != 11 {
+		t.Error("expected 11 rows, got", n)
+	}
+	if n, _ := db.DataCount(); n != 10 {
+		t.Error("expected 10 data objects, got", n)
+	}
+}
+
+// cancelAfter is a context that is canceled once its Err method has been called n times
+type cancelAfter struct {
+	context.Context
+	n int
+}
+
+func (ctx *cancelAfter) Err() error {
+	if ctx.n <= 0 {
+		return context.Canceled
+	}
+	ctx.n--
+	return nil
+}
+
+func TestMatcher(t *testing.T){
+	os.Remove("test/match.db")
+
+	db, err := Open("test/match.db", WithTextLayout(true), WithBitSize(16))
+	if err != nil {
+		t.Error(err)
+	}
+	defer db.Close()
+
+	table, err := db.AddTable("Users")
+	if err != nil {
+		t.Error(err)
+	}
+
+	table.AddRow("user:alice", "admin")
+	table.AddRow("user:bob", "guest")
+	table.AddRow("group:staff", "Admin")
+
+	tests := []struct{
+		key Matcher
+		value Matcher
+		count int
+	}{
+		{Any(), Any(), 3},
+		{Exact("user:bob"), Any(), 1},
+		{Prefix("user:"), Any(), 2},
+		{Suffix(":staff"), Any(), 1},
+		{Glob("user:?o*"), Any(), 1},
+		{Regex(`^(user|group):a`), Any(), 1},
+		{Any(), Exact("admin"), 1},
+		{Any(), CaseInsensitive(Exact("ADMIN")), 2},
+		{CaseInsensitive(Regex(`^USER:`)), Any(), 2},
+	}
+
+	for i, test := range tests {
+		rows, _ := table.FindRowsMatch(test.key, test.value)
+		if len(rows) != test.count {
+			t.Error("test", i, "expected", test.count, "rows, got", len(rows))
+		}
+	}
+
+	if _, err = table.FindRowsMatch(Regex(`(`), Any()); err == nil {
+		t.Error("expected invalid regex to return an error")
+	}
+
+	// a leading 0 byte should never run regex in a matcher
+	if rows, _ := table.FindRowsMatch(Exact("\x00*"), Any()); len(rows) != 0 {
+		t.Error("expected exact match to ignore the regex convention")
+	}
+}
+
+func TestFilter(t *testing.T){
+	os.Remove("test/filter.db")
+
+	db, err := Open("test/filter.db", WithTextLayout(true), WithBitSize(16))
+	if err != nil {
+		t.Error(err)
+	}
+	defer db.Close()
+
+	table, err := db.AddTable("Scores")
+	if err != nil {
+		t.Error(err)
+	}
+
+	for i := 1; i <= 10; i++ {
+		table.AddRow("player"+strconv.Itoa(i), strconv.Itoa(i * 10))
+	}
+
+	highScore := func(key []byte, value []byte) bool {
+		n, err := strconv.Atoi(string(value))
+		return err == nil && n > 50
+	}
+
+	if rows, err := table.Filter(highScore, 0); err != nil || len(rows) != 5 {
+		t.Error("expected 5 rows, got", len(rows), err)
+	}
+
+	if rows, err := table.Filter(highScore, 2); err != nil || len(rows) != 2 {
+		t.Error("expected 2 rows, got", len(rows), err)
+	}
+
+	count := 0
+	err = table.FilterEach(highScore, func(row *Row) bool {
+		count++
+		return row.Key != "player7"
+	})
+	if err != nil || count != 2 {
+		t.Error("expected FilterEach to stop after 2 rows, got", count, err)
+	}
+
+	if _, err = table.Filter(func(key, value []byte) bool { return false }, 0); err != io.EOF {
+		t.Error("expected io.EOF, got", err)
+	}
+}
+
+func TestQuery(t *testing.T){
+	os.Remove("test/query.db")
+
+	db, err := Open("test/query.db", WithTextLayout(true), WithBitSize(16))
+	if err != nil {
+		t.Error(err)
+	}
+	defer db.Close()
+
+	table, err := db.AddTable("MyTable")
+	if err != nil {
+		t.Error(err)
+	}
+
+	table.AddRow("user:alice", "12")
+	table.AddRow("user:bob", "8")
+	table.AddRow("user:carol", "30")
+	table.AddRow("group:staff", "100")
+
+	tests := []struct{
+		query string
+		keys []string
+	}{
+		{`FROM MyTable WHERE key ~ "^user:" AND value > 10 ORDER BY key`, []string{"user:alice", "user:carol"}},
+		{`from MyTable where key ~ '^user:' order by value desc limit 2`, []string{"user:carol", "user:alice"}},
+		{`FROM MyTable WHERE key = "user:bob"`, []string{"user:bob"}},
+		{`FROM MyTable WHERE key = "user:bob" AND value > 10`, []string{}},
+		{`FROM MyTable WHERE NOT (key ~ "^user:" OR value < 50)`, []string{"group:staff"}},
+		{`FROM MyTable WHERE value >= 12 AND value <= 30 ORDER BY value`, []string{"user:alice", "user:carol"}},
+	}
+
+	for _, test := range tests {
+		rows, err := db.Query(test.query)
+		if err != nil && !(err == io.EOF && len(test.keys) == 0) {
+			t.Error(test.query, err)
+			continue
+		}
+
+		if len(rows) != len(test.keys) {
+			t.Error(test.query, "expected", len(test.keys), "rows, got", len(rows))
+			continue
+		}
+
+		for i, row := range rows {
+			if row.Key != test.keys[i] {
+				t.Error(test.query, "expected", test.keys[i], "got", row.Key)
+			}
+		}
+	}
+
+	// a column with numbers and strings is sorted the same way, whatever order the rows were added in
+	values := []string{"10", "b", "9", "1a", "abc", "2", "NaN"}
+	mixed1, _ := db.AddTable("Mixed1")
+	mixed2, _ := db.AddTable("Mixed2")
+	for i := range values {
+		mixed1.AddRow(values[i], values[i])
+		mixed2.AddRow(values[len(values)-1-i], values[len(values)-1-i])
+	}
+
+	expected := []string{"2", "9", "10", "1a", "NaN", "abc", "b"}
+	for _, name := range []string{"Mixed1", "Mixed2"} {
+		rows, err := db.Query(`FROM `+name+` ORDER BY value`)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+
+		keys := []string{}
+		for _, row := range rows {
+			keys = append(keys, row.Key)
+		}
+		if strings.Join(keys, ",") != strings.Join(expected, ",") {
+			t.Error("expected numbers before strings in", name, "got", keys)
+		}
+	}
+
+	for _, query := range []string{`MyTable`, `FROM MyTable WHERE`, `FROM MyTable WHERE name = "x"`, `FROM MyTable LIMIT x`, `FROM MyTable WHERE key ~ "("`} {
+		if _, err := ParseQuery(query); err == nil {
+			t.Error("expected a parse error for:", query)
+		}
+	}
+}
+
+func TestCount(t *testing.T){
+	os.Remove("test/count.db")
+
+	db, err := Open("test/count.db", WithTextLayout(true), WithBitSize(16))
+	if err != nil {
+		t.Error(err)
+	}
+	defer db.Close()
+
+	table, _ := db.AddTable("MyTable")
+	table2, _ := db.AddTable("MyTable2")
+	db.AddData("Data1", "")
+
+	if n, err := db.TableCount(); err != nil || n != 2 {
+		t.Error("expected 2 tables, got", n, err)
+	}
+
+	table2.Del()
+	db.AddTable("MyTable3")
+	db.AddTable("MyTable4")
+
+	if n, err := db.TableCount(); err != nil || n != 3 {
+		t.Error("expected 3 tables, got", n, err)
+	}
+
+	if n, err := db.DataCount(); err != nil || n != 1 {
+		t.Error("expected 1 data object, got", n, err)
+	}
+
+	table.AddRow("user:1", "a")
+	table.AddRow("user:2", "b")
+	table.AddRow("group:1", "c")
+
+	if n, err := table.Count(); err != nil || n != 3 {
+		t.Error("expected 3 rows, got", n, err)
+	}
+
+	if n, err := table.CountMatch(Prefix("user:")); err != nil || n != 2 {
+		t.Error("expected 2 matching rows, got", n, err)
+	}
+
+	if n, err := db.DataCountMatch(Exact("Data1")); err != nil || n != 1 {
+		t.Error("expected 1 matching data object, got", n, err)
+	}
+}
+
+func TestTyped(t *testing.T){
+	os.Remove("test/typed.db")
+
+	db, err := Open("test/typed.db", WithKey([]byte("key123")), WithTextLayout(true), WithBitSize(16))
+	if err != nil {
+		t.Error(err)
+	}
+	defer db.Close()
+
+	table, err := db.AddTable("MyTable")
+	if err != nil {
+		t.Error(err)
+	}
+
+	bin := []byte{0, 255, '=', '%', '\n', 0xc3, 0x28, '-'}
+	row, err := table.AddRowBytes("Binary", bin)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if row, err = table.GetRow("Binary"); err != nil || !bytes.Equal(row.GetBytes(), bin) {
+		t.Error("expected binary value to be preserved, got", row.GetBytes(), err)
+	}
+
+	bin = append(bin, bin...)
+	if err = row.SetBytes(bin); err != nil {
+		t.Error(err)
+	}
+
+	if row, err = table.GetRow("Binary"); err != nil || !bytes.Equal(row.GetBytes(), bin) {
+		t.Error("expected binary value to be preserved, got", row.GetBytes(), err)
+	}
+
+	if data, err := db.AddDataBytes("Data1", bin); err != nil || !bytes.Equal(data.GetBytes(), bin) {
+		t.Error("expected binary data to be preserved", err)
+	}
+
+	if data, err := db.GetData("Data1"); err != nil || !bytes.Equal(data.GetBytes(), bin) {
+		t.Error("expected binary data to be preserved", err)
+	}
+
+	type User struct {
+		Name string
+		Age int
+	}
+
+	for _, codec := range []Codec{JSONCodec, GobCodec} {
+		users, _ := db.AddTable("Users")
+		typed := NewTypedTable[User](users, codec)
+
+		if err = typed.Add("alice", User{Name: "Alice", Age: 30}); err != nil {
+			t.Error(err)
+		}
+
+		if err = typed.Set("alice", User{Name: "Alice", Age: 31}); err != nil {
+			t.Error(err)
+		}
+
+		if user, err := typed.Get("alice"); err != nil || user.Name != "Alice" || user.Age != 31 {
+			t.Error("unexpected user", user, err)
+		}
+
+		if list, err := typed.Find(Any()); err != nil || len(list) != 1 || list[0].Key != "alice" {
+			t.Error("unexpected find result", list, err)
+		}
+
+		users.Del()
+	}
+}
+
+func TestStruct(t *testing.T){
+	os.Remove("test/struct.db")
+
+	db, err := Open("test/struct.db", WithBitSize(64))
+	if err != nil {
+		t.Error(err)
+	}
+	defer db.Close()
+
+	table, err := db.AddTable("Users")
+	if err != nil {
+		t.Error(err)
+	}
+
+	type Base struct {
+		ID int `db:"id"`
+	}
+
+	type UserV1 struct {
+		Base
+		Name string `db:"name"`
+		Email string `db:"email,omitempty"`
+		Password string `db:"-"`
+		Legacy string `db:"legacy"`
+	}
+
+	type UserV2 struct {
+		Base
+		Name string `db:"name"`
+		Email string `db:"email,omitempty"`
+		Admin bool `db:"admin"`
+	}
+
+	if err = table.Put("alice", &UserV1{Base: Base{ID: 1}, Name: "Alice", Password: "secret", Legacy: "old"}); err != nil {
+		t.Error(err)
+	}
+
+	var user1 UserV1
+	if err = table.Get("alice", &user1); err != nil || user1.ID != 1 || user1.Name != "Alice" || user1.Password != "" || user1.Legacy != "old" {
+		t.Error("unexpected user", user1, err)
+	}
+
+	// the struct changed, but the stored row should still load
+	user2 := UserV2{Admin: true}
+	if err = table.Get("alice", &user2); err != nil || user2.ID != 1 || user2.Name != "Alice" || !user2.Admin {
+		t.Error("unexpected user", user2, err)
+	}
+
+	user2.Email = "alice@example.com"
+	if err = table.Put("alice", user2); err != nil {
+		t.Error(err)
+	}
+
+	// fields that the struct does not know are kept
+	if row, err := table.GetRow("alice"); err != nil || !strings.Contains(row.Value, `"legacy":"old"`) || !strings.Contains(row.Value, `"email"`) {
+		t.Error("unexpected stored value", row.Value, err)
+	}
+
+	user2.Email = ""
+	if err = table.Put("alice", &user2); err != nil {
+		t.Error(err)
+	}
+	if row, err := table.GetRow("alice"); err != nil || !strings.Contains(row.Value, `"legacy":"old"`) || strings.Contains(row.Value, `"email"`) {
+		t.Error("expected an empty omitempty field to be removed", row.Value, err)
+	}
+
+	user1 = UserV1{}
+	if err = table.Get("alice", &user1); err != nil || user1.Legacy != "old" || user1.Name != "Alice" {
+		t.Error("expected the older struct to load the kept field", user1, err)
+	}
+
+	if err = table.Get("alice", user2); err == nil {
+		t.Error("expected an error when Get is not passed a pointer")
+	}
+}
+
+func TestColumns(t *testing.T){
+	os.Remove("test/columns.db")
+
+	db, err := Open("test/columns.db", WithTextLayout(true), WithBitSize(16))
+	if err != nil {
+		t.Error(err)
+	}
+	defer db.Close()
+
+	table, err := db.AddTable("Users")
+	if err != nil {
+		t.Error(err)
+	}
+
+	// rows added before the table has columns
+	table.AddRow("legacy", "Old User")
+	table.AddRowBytes("binary", []byte{0, 1, 0, 2})
+
+	if cols := table.Columns(); len(cols) != 1 || cols[0].Name != "value" {
+		t.Error("expected a single value column, got", cols)
+	}
+
+	err = table.SetColumns([]Column{{Name: "name", Type: ColString}, {Name: "age", Type: ColInt}, {Name: "admin", Type: ColBool}})
+	if err != nil {
+		t.Error(err)
+	}
+
+	row, err := table.AddRowColumns("alice", map[string]string{"name": "Alice", "age": "30"})
+	if err != nil {
+		t.Error(err)
+	}
+
+	if _, err = table.AddRowColumns("bob", map[string]string{"name": "Bob", "age": "thirty"}); err == nil {
+		t.Error("expected an error for an invalid int column")
+	}
+
+	if err = row.SetColumn("admin", "true"); err != nil {
+		t.Error(err)
+	}
+
+	// the table schema should be stored with the table
+	table, err = db.GetTable("Users")
+	if err != nil || len(table.Columns()) != 3 {
+		t.Error("expected the table to keep its columns", table.Columns(), err)
+	}
+
+	row, err = table.GetRow("alice")
+	if err != nil {
+		t.Error(err)
+	}
+
+	if cols := row.ColumnMap(); cols["name"] != "Alice" || cols["age"] != "30" || cols["admin"] != "true" || row.Value != "Alice" {
+		t.Error("unexpected columns", cols, row.Value)
+	}
+
+	if err = row.SetValue("Alice Smith"); err != nil {
+		t.Error(err)
+	}
+
+	if rows, err := table.FindRowsMatch(Any(), Exact("Alice Smith")); err != nil || len(rows) != 1 || rows[0].ColumnMap()["age"] != "30" {
+		t.Error("expected to find the row by its first column", rows, err)
+	}
+
+	if err = row.Rename("alice2"); err != nil {
+		t.Error(err)
+	}
+
+	if row, err = table.GetRow("alice2"); err != nil || row.ColumnMap()["admin"] != "true" {
+		t.Error("expected rename to keep the columns", err)
+	}
+
+	if row, err = table.GetRow("legacy"); err != nil || row.Value != "Old User" {
+		t.Error("expected legacy row to keep working", err)
+	}
+
+	if name, _ := row.Column("name"); name != "Old User" {
+		t.Error("expected legacy value to be the first column, got", name)
+	}
+
+	if err = row.SetColumn("age", "40"); err != nil {
+		t.Error(err)
+	}
+
+	if row, err = table.GetRow("legacy"); err != nil || row.ColumnMap()["age"] != "40" || row.Value != "Old User" {
+		t.Error("unexpected legacy row after SetColumn", row.ColumnMap(), err)
+	}
+
+	// two handles to the same row keep each other's columns
+	row1, _ := table.GetRow("alice2")
+	row2, _ := table.GetRow("alice2")
+	if err = row1.SetColumn("age", "31"); err != nil {
+		t.Error(err)
+	}
+	if err = row2.SetColumn("admin", "false"); err != nil {
+		t.Error(err)
+	}
+	if row, err = table.GetRow("alice2"); err != nil || row.ColumnMap()["age"] != "31" || row.ColumnMap()["admin"] != "false" || row.Value != "Alice Smith" {
+		t.Error("expected both columns to be kept", row.ColumnMap(), err)
+	}
+
+	// a rename keeps changes made through another handle
+	if err = row1.SetValue("Alice Jones"); err != nil {
+		t.Error(err)
+	}
+	if err = row2.Rename("alice3"); err != nil {
+		t.Error(err)
+	}
+	if row, err = table.GetRow("alice3"); err != nil || row.Value != "Alice Jones" || row.ColumnMap()["admin"] != "false" {
+		t.Error("expected rename to keep the stored row", row.Value, row.ColumnMap(), err)
+	}
+
+	table.SetColumns(nil)
+	if row, err = table.GetRow("binary"); err != nil || !bytes.Equal(row.GetBytes(), []byte{0, 1, 0, 2}) {
+		t.Error("expected binary value with a leading 0 to be preserved", row.GetBytes(), err)
+	}
+}
+
+func TestTTL(t *testing.T){
+	os.Remove("test/ttl.db")
+
+	db, err := Open("test/ttl.db", WithTextLayout(true), WithBitSize(16))
+	if err != nil {
+		t.Error(err)
+	}
+	defer db.Close()
+
+	table, err := db.AddTable("Sessions")
+	if err != nil {
+		t.Error(err)
+	}
+
+	table.AddRow("forever", "Keep")
+	if _, err = table.AddRowExpire("old", "Expired", time.Now().Add(-time.Second)); err != nil {
+		t.Error(err)
+	}
+	row, err := table.AddRowTTL("new", "Fresh", time.Hour)
+	if err != nil {
+		t.Error(err)
+	}
+	if exp, ok := row.Expire(); !ok || exp.Before(time.Now()) {
+		t.Error("expected row to expire in the future", exp, ok)
+	}
+
+	if _, err = table.GetRow("old"); err == nil {
+		t.Error("expected expired row to be missing")
+	}
+	if row, err = table.GetRow("new"); err != nil || row.Value != "Fresh" {
+		t.Error("expected row with a ttl to be found", err)
+	}
+	if rows, _ := table.FindRowsMatch(Any(), Any()); len(rows) != 2 {
+		t.Error("expected find to skip the expired row, found", len(rows))
+	}
+
+	// SetValue keeps the expiration
+	row.SetValue("Still Fresh")
+	if row, err = table.GetRow("new"); err != nil || row.Value != "Still Fresh" {
+		t.Error("expected updated row", err)
+	}else if _, ok := row.Expire(); !ok {
+		t.Error("expected SetValue to keep the expiration")
+	}
+
+	if err = row.SetValueExpire("Gone", time.Now().Add(-time.Second)); err != nil {
+		t.Error(err)
+	}
+	if _, err = table.GetRow("new"); err == nil {
+		t.Error("expected row to be missing after it expired")
+	}
+
+	// an expired row can be replaced
+	if _, err = table.AddRow("old", "Replaced"); err != nil {
+		t.Error(err)
+	}
+	if row, err = table.GetRow("old"); err != nil || row.Value != "Replaced" {
+		t.Error("expected replaced row", err)
+	}
+
+	if n, err := db.ReapExpired(); err != nil || n != 1 {
+		t.Error("expected 1 reaped row, got", n, err)
+	}
+
+	table, _ = db.GetTable("Sessions")
+	if n, _ := table.Count(); n != 2 {
+		t.Error("expected reaped rows to be removed from the row list, got", n)
+	}
+
+	// SetValue through another handle keeps an expiry set through the first one
+	row1, _ := table.GetRow("forever")
+	row2, _ := table.GetRow("forever")
+	if err = row1.SetValueTTL("Temp", time.Hour); err != nil {
+		t.Error(err)
+	}
+	if err = row2.SetValue("Still Temp"); err != nil {
+		t.Error(err)
+	}
+	if row, err = table.GetRow("forever"); err != nil || row.Value != "Still Temp" {
+		t.Error("expected updated row", err)
+	}else if _, ok := row.Expire(); !ok {
+		t.Error("expected SetValue through another handle to keep the expiration")
+	}
+
+	// the expiry is stored for a table with columns
+	users, _ := db.AddTable("Users")
+	users.SetColumns([]Column{{Name: "name", Type: ColString}, {Name: "age", Type: ColInt}})
+	user, _ := users.AddRow("user:1", "Alice")
+	user.SetColumn("age", "30")
+	if err = user.SetValueTTL("Alice", time.Hour); err != nil {
+		t.Error(err)
+	}
+	if user, err = users.GetRow("user:1"); err != nil {
+		t.Error(err)
+	}else if _, ok := user.Expire(); !ok {
+		t.Error("expected SetValueTTL to store the expiration for a table with columns")
+	}else if age, _ := user.Column("age"); age != "30" {
+		t.Error("expected SetValueTTL to keep the other columns, got", age)
+	}
+}
+
+func TestCompareAndSet(t *testing.T){
+	os.Remove("test/atomic.db")
+
+	db, err := Open("test/atomic.db", WithTextLayout(true), WithBitSize(16))
+	if err != nil {
+		t.Error(err)
+	}
+	defer db.Close()
+
+	table, err := db.AddTable("Items")
+	if err != nil {
+		t.Error(err)
+	}
+
+	table.AddRow("item", "A")
+	row1, _ := table.GetRow("item")
+	row2, _ := table.GetRow("item")
+
+	if err = row1.CompareAndSet("A", "B"); err != nil {
+		t.Error(err)
+	}
+	if err = row2.CompareAndSet("A", "C"); err != ErrConflict {
+		t.Error("expected a conflict, got", err)
+	}else if row2.Value != "B" {
+		t.Error("expected conflict to refresh the row, got", row2.Value)
+	}
+	if err = row2.CompareAndSet(row2.Value, "C"); err != nil {
+		t.Error(err)
+	}
+	if row, _ := table.GetRow("item"); row.Value != "C" {
+		t.Error("expected stored value C, got", row.Value)
+	}
+
+	// a successful swap keeps the expiry set through another handle
+	if err = row1.SetValueTTL("D", time.Hour); err != nil {
+		t.Error(err)
+	}
+	if err = row2.CompareAndSet("D", "E"); err != nil {
+		t.Error(err)
+	}
+	if row, _ := table.GetRow("item"); row.Value != "E" {
+		t.Error("expected stored value E, got", row.Value)
+	}else if _, ok := row.Expire(); !ok {
+		t.Error("expected CompareAndSet to keep the expiry of the stored row")
+	}
+
+	data, _ := db.AddData("setting", "on")
+	if err = data.CompareAndSet("off", "on"); err != ErrConflict {
+		t.Error("expected a conflict, got", err)
+	}
+	if err = data.CompareAndSet("on", "off"); err != nil {
+		t.Error(err)
+	}
+
+	done := make(chan bool)
+	for i := 0; i < 10; i++ {
+		go func(){
+			table.Increment("count", 2)
+			done <- true
+		}()
+	}
+	for i := 0; i < 10; i++ {
+		<-done
+	}
+
+	if n, err := table.Increment("count", -5); err != nil || n != 15 {
+		t.Error("expected count 15, got", n, err)
+	}
+
+	if _, err = table.Increment("item", 1); err == nil {
+		t.Error("expected increment of a non integer value to fail")
+	}
+}
+
+func TestBulk(t *testing.T){
+	os.Remove("test/bulk.db")
+
+	db, err := Open("test/bulk.db", WithTextLayout(true), WithBitSize(16))
+	if err != nil {
+		t.Error(err)
+	}
+	defer db.Close()
+
+	table, err := db.AddTable("Users")
+	if err != nil {
+		t.Error(err)
+	}
+
+	if _, err = table.SetRow("user:1", "Alice"); err != nil {
+		t.Error(err)
+	}
+	if _, err = table.SetRow("user:1", "Alicia"); err != nil {
+		t.Error(err)
+	}
+	table.SetRow("user:2", "Bob")
+	table.SetRow("user:3", "Carol")
+	table.SetRow("admin:1", "Dave")
+
+	if n, _ := table.Count(); n != 4 {
+		t.Error("expected SetRow to update an existing row, got", n, "rows")
+	}
+	if row, err := table.GetRow("user:1"); err != nil || row.Value != "Alicia" {
+		t.Error("expected updated value", err)
+	}
+
+	n, err := table.UpdateWhere(Prefix("user:"), func(key, value string) (string, bool) {
+		if key == "user:3" {
+			return "", false
+		}
+		return strings.ToUpper(value), true
+	})
+	if err != nil || n != 2 {
+		t.Error("expected 2 updated rows, got", n, err)
+	}
+	if row, _ := table.GetRow("user:2"); row.Value != "BOB" {
+		t.Error("expected BOB, got", row.Value)
+	}
+	if row, _ := table.GetRow("user:3"); row.Value != "Carol" {
+		t.Error("expected skipped row to be unchanged, got", row.Value)
+	}
+
+	if n, err = table.DeleteWhere(Prefix("user:")); err != nil || n != 3 {
+		t.Error("expected 3 deleted rows, got", n, err)
+	}
+	if n, _ := table.Count(); n != 1 {
+		t.Error("expected 1 row left, got", n)
+	}
+	if _, err = table.GetRow("user:2"); err == nil {
+		t.Error("expected deleted row to be missing")
+	}
+
+	table, _ = db.GetTable("Users")
+	if rows, _ := table.FindRowsMatch(Any(), Any()); len(rows) != 1 || rows[0].Key != "admin:1" {
+		t.Error("expected only admin:1 to be left")
+	}
+}
+
+func TestRowMembership(t *testing.T){
+	os.Remove("test/membership.db")
+
+	db, err := Open("test/membership.db", WithTextLayout(true), WithBitSize(16))
+	if err != nil {
+		t.Error(err)
+	}
+	defer db.Close()
+
+	users, _ := db.AddTable("Users")
+	posts, _ := db.AddTable("Posts")
+
+	row, _ := users.AddRow("alice", "Alice")
+	users.AddRow("bob", "Bob")
+
+	if err = row.Del(); err != nil {
+		t.Error(err)
+	}
+	if n, _ := users.Count(); n != 1 {
+		t.Error("expected deleted row to be removed from the row list, got", n)
+	}
+
+	// the freed block is reused by another table
+	posts.AddRow("post", "Hello")
+
+	users, _ = db.GetTable("Users")
+	if rows, _ := users.FindRowsMatch(Any(), Any()); len(rows) != 1 || rows[0].Key != "bob" {
+		t.Error("expected a row from another table to never show up in this table")
+	}
+
+	if err = row.Del(); err == nil {
+		t.Error("expected deleting a row twice to fail")
+	}
+	if _, err = posts.GetRow("post"); err != nil {
+		t.Error("expected row in another table to survive a second delete", err)
+	}
+
+	row, _ = users.AddRow("carol", "Carol")
+	if err = row.Rename("bob"); err == nil {
+		t.Error("expected rename to an existing key to fail")
+	}
+	if err = row.Rename("carol"); err != nil {
+		t.Error(err)
+	}
+	if err = row.Rename("dave"); err != nil {
+		t.Error(err)
+	}
+	if _, err = users.GetRow("dave"); err != nil {
+		t.Error(err)
+	}
+
+	// a rename keeps a value set through another handle
+	other, _ := users.GetRow("dave")
+	if err = other.SetValue("Dave"); err != nil {
+		t.Error(err)
+	}
+	if err = row.Rename("erin"); err != nil {
+		t.Error(err)
+	}
+	if row, err = users.GetRow("erin"); err != nil || row.Value != "Dave" {
+		t.Error("expected rename to keep the stored value, got", row.Value, err)
+	}
+}
+
+func TestTableHandles(t *testing.T){
+	os.Remove("test/handles.db")
+
+	db, err := Open("test/handles.db", WithTextLayout(true), WithBitSize(16))
+	if err != nil {
+		t.Error(err)
+	}
+	defer db.Close()
+
+	db.AddTable("Users")
+
+	table1, _ := db.GetTable("Users")
+	table2, _ := db.GetTable("Users")
+
+	table1.AddRow("alice", "Alice")
+	if _, err = table2.GetRow("alice"); err != nil {
+		t.Error("expected a row added by one handle to be seen by the other", err)
+	}
+
+	table2.AddRow("bob", "Bob")
+	if rows, _ := table1.FindRowsMatch(Any(), Any()); len(rows) != 2 {
+		t.Error("expected 2 rows, got", len(rows))
+	}
+
+	table, _ := db.GetTable("Users")
+	if n, _ := table.Count(); n != 2 {
+		t.Error("expected no rows to be lost, got", n)
+	}
+
+	if err = table1.Del(); err != nil {
+		t.Error(err)
+	}
+	if _, err = table2.AddRow("carol", "Carol"); err != ErrTableDeleted {
+		t.Error("expected ErrTableDeleted, got", err)
+	}
+	if _, err = table2.GetRow("alice"); err != ErrTableDeleted {
+		t.Error("expected ErrTableDeleted, got", err)
+	}
+
+	newTable, _ := db.AddTable("Users")
+	if _, err = newTable.AddRow("dave", "Dave"); err != nil {
+		t.Error(err)
+	}
+	if _, err = table2.FindRowsMatch(Any(), Any()); err != ErrTableDeleted {
+		t.Error("expected a stale handle to stay deleted, got", err)
+	}
+}
+
+func TestStaleHandles(t *testing.T){
+	os.Remove("test/stale.db")
+
+	db, err := Open("test/stale.db", WithTextLayout(true), WithBitSize(16))
+	if err != nil {
+		t.Error(err)
+	}
+	defer db.Close()
+
+	table, _ := db.AddTable("Users")
+	table.AddRow("alice", "Alice")
+
+	row1, _ := table.GetRow("alice")
+	row2, _ := table.GetRow("alice")
+	if err = row1.Del(); err != nil {
+		t.Error(err)
+	}
+
+	// the freed block is reused by a new row
+	table.AddRow("bob", "Bob")
+	if err = row2.SetValue("Changed"); err != ErrStaleHandle {
+		t.Error("expected ErrStaleHandle, got", err)
+	}
+	if row, _ := table.GetRow("bob"); row.Value != "Bob" {
+		t.Error("expected a stale handle to never change another row, got", row.Value)
+	}
+
+	data1, _ := db.AddData("key", "value")
+	data2, _ := db.GetData("key")
+	data1.Del()
+	db.AddData("other", "value")
+	if err = data2.SetValue("changed"); err != ErrStaleHandle {
+		t.Error("expected ErrStaleHandle, got", err)
+	}
+
+	row, _ := table.GetRow("bob")
+	table.AddRowExpire("old", "Expired", time.Now().Add(-time.Second))
+	if err = db.Optimize(); err != nil {
+		t.Error(err)
+	}
+
+	if err = row.SetValue("Robert"); err != ErrStaleHandle {
+		t.Error("expected ErrStaleHandle after Optimize, got", err)
+	}
+	if _, err = table.GetRow("bob"); err != ErrStaleHandle {
+		t.Error("expected ErrStaleHandle after Optimize, got", err)
+	}
+
+	table, err = db.GetTable("Users")
+	if err != nil {
+		t.Error(err)
+	}
+	if row, err = table.GetRow("bob"); err != nil || row.Value != "Bob" {
+		t.Error("expected row to survive Optimize", err)
+	}
+	if n, _ := table.Count(); n != 1 {
+		t.Error("expected expired rows to be removed by Optimize, got", n)
+	}
+	if err = row.SetValue("Robert"); err != nil {
+		t.Error(err)
+	}
+	if data, err := db.GetData("other"); err != nil || data.Value != "value" {
+		t.Error("expected data to survive Optimize", err)
+	}
+}
+
+func TestWatch(t *testing.T){
+	os.Remove("test/watch.db")
+
+	db, err := Open("test/watch.db", WithTextLayout(true), WithBitSize(16))
+	if err != nil {
+		t.Error(err)
+	}
+	defer db.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	changes := db.Watch(ctx, nil)
+	rowChanges := db.Watch(ctx, func(change Change) bool {
+		return change.Table == "Users" && change.Key != ""
+	})
+
+	table, _ := db.AddTable("Users")
+	row, _ := table.AddRow("alice", "Alice")
+	row.SetValue("Alicia")
+	row.Rename("alicia")
+	row.Del()
+	table.Rename("People")
+	db.AddData("key", "value")
+
+	expected := []Change{
+		{Op: OpAddTable, Table: "Users"},
+		{Op: OpAddRow, Table: "Users", Key: "alice", NewValue: "Alice"},
+		{Op: OpSetRow, Table: "Users", Key: "alice", OldValue: "Alice", NewValue: "Alicia"},
+		{Op: OpRenameRow, Table: "Users", Key: "alicia", OldKey: "alice", NewValue: "Alicia"},
+		{Op: OpDelRow, Table: "Users", Key: "alicia", OldValue: "Alicia"},
+		{Op: OpRenameTable, Table: "People", OldTable: "Users"},
+		{Op: OpAddData, Key: "key", NewValue: "value"},
+	}
+
+	for _, exp := range expected {
+		select {
+		case change := <-changes:
+			if change != exp {
+				t.Error("expected", exp, "got", change)
+			}
+		case <-time.After(time.Second):
+			t.Error("expected", exp, "got nothing")
+		}
+	}
+
+	for _, exp := range expected[1:5] {
+		select {
+		case change := <-rowChanges:
+			if change != exp {
+				t.Error("expected filtered", exp, "got", change)
+			}
+		case <-time.After(time.Second):
+			t.Error("expected filtered", exp, "got nothing")
+		}
+	}
+
+	cancel()
+	select {
+	case _, ok := <-changes:
+		if ok {
+			t.Error("expected no more changes")
+		}
+	case <-time.After(time.Second):
+		t.Error("expected channel to close after the context is done")
+	}
+}
+
+func TestChangeLog(t *testing.T){
+	os.Remove("test/changelog.db")
+	os.Remove("test/changelog.changes")
+
+	db, err := Open("test/changelog.db", WithTextLayout(true), WithBitSize(16))
+	if err != nil {
+		t.Error(err)
+	}
+
+	if err = db.EnableChangeLog(ChangeLogRetention{MaxEntries: 10}); err != nil {
+		t.Error(err)
+	}
+
+	table, _ := db.AddTable("Counters")
+	for i := 0; i < 5; i++ {
+		table.Increment("count", 1)
+	}
+	db.AddData("key", "value")
+	db.Close()
+
+	db, err = Open("test/changelog.db", WithTextLayout(true), WithBitSize(16))
+	if err != nil {
+		t.Error(err)
+	}
+	defer db.Close()
+
+	if err = db.EnableChangeLog(ChangeLogRetention{MaxEntries: 10}); err != nil {
+		t.Error(err)
+	}
+	if seq, _ := db.ChangeLogSeq(); seq != 7 {
+		t.Error("expected seq 7 after a restart, got", seq)
+	}
+
+	entries := []ChangeLogEntry{}
+	db.ReadChangeLog(5, func(entry ChangeLogEntry) bool {
+		entries = append(entries, entry)
+		return true
+	})
+	if len(entries) != 2 || entries[0].Seq != 6 || entries[0].NewValue != "5" || entries[1].Op != OpAddData {
+		t.Error("expected to resume after seq 5, got", entries)
+	}
+
+	table, _ = db.GetTable("Counters")
+	for i := 0; i < 20; i++ {
+		table.Increment("count", 1)
+	}
+
+	db.TruncateChangeLog()
+
+	count := 0
+	last := uint64(0)
+	db.ReadChangeLog(0, func(entry ChangeLogEntry) bool {
+		if entry.Seq <= last {
+			t.Error("expected increasing seq, got", entry.Seq, "after", last)
+		}
+		last = entry.Seq
+		count++
+		return true
+	})
+	if count != 10 || last != 27 {
+		t.Error("expected the latest 10 entries to be kept, got", count, "ending at", last)
+	}
+	db.Close()
+
+	// a line that was only partly written before a crash is removed when the log is opened
+	file, err := os.OpenFile("test/changelog.changes", os.O_WRONLY|os.O_APPEND, 0755)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	file.Write([]byte(`{"seq":28,"ti`))
+	file.Close()
+
+	db, err = Open("test/changelog.db", WithTextLayout(true), WithBitSize(16))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer db.Close()
+
+	if err = db.EnableChangeLog(ChangeLogRetention{MaxEntries: 10}); err != nil {
+		t.Error(err)
+	}
+	table, _ = db.GetTable("Counters")
+	if _, err = table.Increment("count", 1); err != nil {
+		t.Error(err)
+	}
+
+	last = 0
+	if err = db.ReadChangeLog(0, func(entry ChangeLogEntry) bool {
+		last = entry.Seq
+		return true
+	}); err != nil || last != 28 {
+		t.Error("expected the log to continue after a partly written line, got", last, err)
+	}
+
+	// each can write to the database while the log is read
+	done := make(chan error)
+	go func(){
+		done <- db.ReadChangeLog(27, func(entry ChangeLogEntry) bool {
+			_, err := table.Increment("count", 1)
+			return err == nil
+		})
+	}()
+	select {
+	case err = <-done:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("expected a write inside ReadChangeLog to not block")
+		return
+	}
+	if seq, _ := db.ChangeLogSeq(); seq != 29 {
+		t.Error("expected the write inside ReadChangeLog to be logged, got seq", seq)
+	}
+
+	// a failed rewrite is reported, and the log is left as it was
+	os.Mkdir("test/changelog.changes.tmp", 0755)
+	os.WriteFile("test/changelog.changes.tmp/block", []byte{}, 0755)
+	if err = db.TruncateChangeLog(); err == nil {
+		t.Error("expected TruncateChangeLog to fail")
+	}
+	os.RemoveAll("test/changelog.changes.tmp")
+
+	// the log keeps working after a failed rewrite
+	seq, _ := db.ChangeLogSeq()
+	if _, err = table.Increment("count", 1); err != nil {
+		t.Error(err)
+	}
+	last = 0
+	db.ReadChangeLog(seq, func(entry ChangeLogEntry) bool {
+		last = entry.Seq
+		return true
+	})
+	if last != seq+1 {
+		t.Error("expected a write after a failed rewrite to be logged, got", last)
+	}
+
+	// a change that could not be logged is still stored, but the error is returned
+	db.changeLog.file.Close()
+	var logErr *ChangeLogError
+	if _, err = table.AddRow("unlogged", "1"); !errors.As(err, &logErr) {
+		t.Error("expected a *ChangeLogError, got", err)
+	}
+	if _, err = table.GetRow("unlogged"); err != nil {
+		t.Error("expected the row to be stored", err)
+	}
+}
+
+func TestHooks(t *testing.T){
+	os.Remove("test/hooks.db")
+
+	db, err := Open("test/hooks.db", WithTextLayout(true), WithBitSize(16))
+	if err != nil {
+		t.Error(err)
+	}
+	defer db.Close()
+
+	users, _ := db.AddTable("Users")
+	stats, _ := db.AddTable("Stats")
+
+	db.BeforeWrite("Users", func(change Change) error {
+		if change.Op == OpDelRow && change.Key == "admin" {
+			return errors.New("admin cannot be removed")
+		}else if change.NewValue == "" && (change.Op == OpAddRow || change.Op == OpSetRow) {
+			return errors.New("name cannot be empty")
+		}
+		return nil
+	})
+
+	// after hooks run inside the lock, so they must set noLock to true
+	db.AfterWrite("Users", func(change Change) {
+		if change.Op == OpAddRow {
+			stats.Increment("users", 1, true)
+		}else if change.Op == OpDelRow {
+			stats.Increment("users", -1, true)
+		}
+	})
+
+	globalCount := 0
+	db.AfterWrite("", func(change Change) {
+		globalCount++
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	changes := db.Watch(ctx, nil)
+
+	admin, _ := users.AddRow("admin", "Admin")
+
+	// a write made by a hook is sent to watchers after the change that ran the hook
+	if change := <-changes; change.Op != OpAddRow || change.Table != "Users" {
+		t.Error("expected the added user first, got", change)
+	}
+	if change := <-changes; change.Table != "Stats" {
+		t.Error("expected the hook's increment second, got", change)
+	}
+	cancel()
+
+	users.AddRow("alice", "Alice")
+	if _, err = users.AddRow("bob", ""); err == nil {
+		t.Error("expected hook to reject an empty name")
+	}
+	if _, err = users.GetRow("bob"); err == nil {
+		t.Error("expected rejected row to not be added")
+	}
+
+	if err = admin.SetValue(""); err == nil {
+		t.Error("expected hook to reject an empty name")
+	}else if admin.Value != "Admin" {
+		t.Error("expected rejected value to leave the row unchanged, got", admin.Value)
+	}
+
+	if err = admin.Del(); err == nil || err.Error() != "admin cannot be removed" {
+		t.Error("expected hook to reject the delete, got", err)
+	}
+	if _, err = users.GetRow("admin"); err != nil {
+		t.Error("expected admin to still exist", err)
+	}
+
+	row, _ := users.GetRow("alice")
+	row.Del()
+
+	if row, err := stats.GetRow("users"); err != nil || row.Value != "1" {
+		t.Error("expected after hooks to keep the user count, got", row.Value, err)
+	}
+
+	// 2 users, 3 increments and 1 delete
+	if globalCount != 6 {
+		t.Error("expected 6 writes from the global hook, got", globalCount)
+	}
+}
+
+func TestSchema(t *testing.T){
+	os.Remove("test/schema.db")
+
+	db, err := Open("test/schema.db", WithTextLayout(true), WithBitSize(16))
+	if err != nil {
+		t.Error(err)
+	}
+
+	table, _ := db.AddTable("Users")
+	table.AddRow("legacy", "not json")
+
+	if err = table.SetSchema(&Schema{KeyPattern: `[`}); err == nil {
+		t.Error("expected an invalid pattern to be rejected")
+	}
+
+	userSchema := &JSONSchema{}
+	err = json.Unmarshal([]byte(`{
+		"type": "object",
+		"required": ["name"],
+		"properties": {
+			"name": {"type": "string", "minLength": 1},
+			"age": {"type": "integer", "minimum": 0},
+			"role": {"enum": ["admin", "user"]},
+			"tags": {"type": "array", "items": {"type": "string", "maxLength": 5}}
+		}
+	}`), userSchema)
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = table.SetSchema(&Schema{KeyPattern: `^user:[0-9]+$`, MaxValueLength: 100, JSON: userSchema})
+	if err != nil {
+		t.Error(err)
+	}
+
+	// the schema is stored with the table
+	db.Close()
+	db, _ = Open("test/schema.db", WithTextLayout(true), WithBitSize(16))
+	defer db.Close()
+
+	table, _ = db.GetTable("Users")
+	if table.Schema() == nil || table.Schema().KeyPattern != `^user:[0-9]+$` {
+		t.Error("expected schema to be stored with the table")
+	}
+
+	// the returned schema is a copy, so changing it does not change the table
+	copied := table.Schema()
+	copied.JSON.Properties["role"].Enum[0] = "owner"
+	copied.JSON.Properties["name"].MinLength = nil
+	if role := table.Schema().JSON.Properties["role"]; role.Enum[0] != "admin" || table.Schema().JSON.Properties["name"].MinLength == nil {
+		t.Error("expected changes to the returned schema to not affect the table")
+	}
+
+	if err = table.SetSchema(&Schema{JSON: &JSONSchema{Enum: []any{func(){}}}}); err == nil {
+		t.Error("expected an enum value that cannot be stored to be rejected")
+	}
+
+	if _, err = table.AddRow("user:1", `{"name": "Alice", "age": 30, "role": "admin", "tags": ["a", "b"]}`); err != nil {
+		t.Error(err)
+	}
+
+	failed := []struct{
+		key string
+		value string
+		rule string
+		path string
+	}{
+		{"alice", `{"name": "Alice"}`, "keyPattern", "key"},
+		{"user:2", `{"name": "Alice"`, "json", "value"},
+		{"user:2", `{"age": 30}`, "required", "$"},
+		{"user:2", `{"name": ""}`, "minLength", "$.name"},
+		{"user:2", `{"name": "Bob", "age": 1.5}`, "type", "$.age"},
+		{"user:2", `{"name": "Bob", "age": -1}`, "minimum", "$.age"},
+		{"user:2", `{"name": "Bob", "role": "owner"}`, "enum", "$.role"},
+		{"user:2", `{"name": "Bob", "tags": ["ok", "too long"]}`, "maxLength", "$.tags[1]"},
+		{"user:2", `{"name": "`+strings.Repeat("a", 100)+`"}`, "maxValueLength", "value"},
+	}
+
+	for _, f := range failed {
+		_, err := table.AddRow(f.key, f.value)
+		if schemaErr, ok := err.(*SchemaError); !ok {
+			t.Error("expected a schema error for", f.value, "got", err)
+		}else if schemaErr.Rule != f.rule || schemaErr.Path != f.path {
+			t.Error("expected", f.rule, "at", f.path, "got", schemaErr)
+		}
+	}
+
+	row, _ := table.GetRow("user:1")
+	if err = row.SetValue(`{"name": 1}`); err == nil {
+		t.Error("expected SetValue to follow the schema")
+	}else if row.Value == `{"name": 1}` {
+		t.Error("expected rejected value to leave the row unchanged")
+	}
+	if err = row.Rename("admin"); err == nil {
+		t.Error("expected Rename to follow the schema")
+	}
+
+	// existing rows keep their values
+	if _, err = table.GetRow("legacy"); err != nil {
+		t.Error(err)
+	}
+
+	table.SetSchema(nil)
+	if _, err = table.AddRow("anything", "goes"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestHistory(t *testing.T){
+	os.Remove("test/history.db")
+
+	db, err := Open("test/history.db", WithTextLayout(true), WithBitSize(16))
+	if err != nil {
+		t.Error(err)
+	}
+	defer db.Close()
+
+	table, _ := db.AddTable("Prices")
+	if err = table.SetVersioning(&Versioning{MaxVersions: 3}); err != nil {
+		t.Error(err)
+	}
+
+	start := time.Now()
+	row, _ := table.AddRow("apple", "1")
+
+	times := []time.Time{}
+	for _, price := range []string{"2", "3", "4", "5"} {
+		time.Sleep(5 * time.Millisecond)
+		times = append(times, time.Now())
+		time.Sleep(5 * time.Millisecond)
+		if err = row.SetValue(price); err != nil {
+			t.Error(err)
+		}
+	}
+
+	history, err := row.History()
+	if err != nil {
+		t.Error(err)
+	}
+	if len(history) != 3 || history[0].Value != "2" || history[2].Value != "4" {
+		t.Error("expected the previous 3 values, got", history)
+	}
+
+	if row, err := table.GetRowAt("apple", times[2]); err != nil || row.Value != "3" {
+		t.Error("expected value 3 at that time, got", row.Value, err)
+	}
+	if row, err := table.GetRowAt("apple", time.Now()); err != nil || row.Value != "5" {
+		t.Error("expected the current value, got", row.Value, err)
+	}
+	if _, err := table.GetRowAt("apple", times[0]); err == nil {
+		t.Error("expected an error for a version that is no longer kept")
+	}
+	if _, err := table.GetRowAt("apple", start.Add(-time.Second)); err == nil {
+		t.Error("expected an error before the row existed")
+	}
+
+	// undo the last write
+	past, _ := table.GetRowAt("apple", times[3])
+	if err = past.SetValue(past.Value); err != nil {
+		t.Error(err)
+	}
+	if row, _ := table.GetRow("apple"); row.Value != "4" {
+		t.Error("expected the value to be restored, got", row.Value)
+	}
+
+	if err = db.Optimize(); err != nil {
+		t.Error(err)
+	}
+
+	table, _ = db.GetTable("Prices")
+	row, _ = table.GetRow("apple")
+	if history, err := row.History(); err != nil || len(history) != 3 || history[2].Value != "5" {
+		t.Error("expected history to survive Optimize, got", history, err)
+	}
+
+	// removing a row also removes its history
+	row.Del()
+	if n, _ := countPrefix(db, '^'); n != 0 {
+		t.Error("expected history to be removed with the row, found", n)
+	}
+}
+
+func TestSnapshot(t *testing.T){
+	os.Remove("test/snapshot.db")
+
+	db, err := Open("test/snapshot.db", WithTextLayout(true), WithBitSize(16))
+	if err != nil {
+		t.Error(err)
+	}
+	defer db.Close()
+
+	table, _ := db.AddTable("Users")
+	for i := 0; i < 20; i++ {
+		table.AddRow("user:"+strconv.Itoa(i), "User "+strconv.Itoa(i))
+	}
+	db.AddData("key", "before")
+
+	snap, err := db.Snapshot()
+	if err != nil {
+		t.Error(err)
+	}
+
+	// writes continue while the snapshot is open
+	row, _ := table.GetRow("user:0")
+	row.SetValue("Changed with a much longer value that needs more blocks")
+	if row, err := table.GetRow("user:1"); err == nil {
+		row.Del()
+	}
+	table.AddRow("user:new", "New User")
+	data, _ := db.GetData("key")
+	data.SetValue("after")
+
+	snapTable, err := snap.GetTable("Users")
+	if err != nil {
+		t.Error(err)
+	}
+	rows, _ := snapTable.FindRowsMatch(Any(), Any())
+	if len(rows) != 20 {
+		t.Error("expected the snapshot to have 20 rows, got", len(rows))
+	}
+	for _, row := range rows {
+		if row.Value != "User "+strings.TrimPrefix(row.Key, "user:") {
+			t.Error("expected the snapshot to keep the old value of", row.Key, "got", row.Value)
+		}
+	}
+	if data, err := snap.GetData("key"); err != nil || data.Value != "before" {
+		t.Error("expected the snapshot to keep the old data value", err)
+	}
+
+	if _, err = snapTable.AddRow("user:snap", "Snapshot"); err != ErrReadOnly {
+		t.Error("expected ErrReadOnly, got", err)
+	}
+	if err = rows[0].SetValue("Changed"); err != ErrReadOnly {
+		t.Error("expected ErrReadOnly, got", err)
+	}
+
+	if err = db.Optimize(); err == nil {
+		t.Error("expected Optimize to fail while a snapshot is open")
+	}
+
+	// a long scan of the snapshot does not block writers
+	done := make(chan bool)
+	snap.mu.Lock()
+	go func(){
+		table.AddRow("user:concurrent", "Concurrent")
+		done <- true
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Error("expected writes to continue while the snapshot is locked")
+	}
+	snap.mu.Unlock()
+
+	snap.Close()
+
+	if n, _ := table.Count(); n != 21 {
+		t.Error("expected 21 rows in the database, got", n)
+	}
+	if err = db.Optimize(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestOpenModes(t *testing.T){
+	os.Remove("test/modes.db")
+
+	if _, err := Open("test/modes.db", WithReadOnly(), WithTextLayout(true), WithBitSize(16)); err == nil {
+		t.Error("expected read only mode to fail for a missing database")
+	}
+
+	db, err := Open("test/modes.db", WithMode(ModeExclusive), WithTextLayout(true), WithBitSize(16))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	table, _ := db.AddTable("Users")
+	table.AddRow("user:1", "User 1")
+
+	if _, err = Open("test/modes.db", WithMode(ModeExclusive), WithTextLayout(true), WithBitSize(16)); err != ErrLocked {
+		t.Error("expected ErrLocked for a second writer, got", err)
+	}
+	if _, err = Open("test/modes.db", WithReadOnly(), WithTextLayout(true), WithBitSize(16)); err != ErrLocked {
+		t.Error("expected ErrLocked for a reader, got", err)
+	}
+
+	// the lock is taken again after the file is replaced
+	if err = db.Optimize(); err != nil {
+		t.Error(err)
+	}
+	if _, err = Open("test/modes.db", WithMode(ModeExclusive), WithTextLayout(true), WithBitSize(16)); err != ErrLocked {
+		t.Error("expected ErrLocked after Optimize, got", err)
+	}
+
+	// the locked file is the one that is written to after Optimize
+	table, _ = db.GetTable("Users")
+	if _, err = table.AddRow("user:3", "User 3"); err != nil {
+		t.Error(err)
+	}
+
+	db.Close()
+
+	reader1, err := Open("test/modes.db", WithReadOnly(), WithTextLayout(true), WithBitSize(16))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer reader1.Close()
+
+	if users, err := reader1.GetTable("Users"); err != nil {
+		t.Error(err)
+	}else if _, err = users.GetRow("user:3"); err != nil {
+		t.Error("expected a row added after Optimize to be stored", err)
+	}
+
+	reader2, err := Open("test/modes.db", WithReadOnly(), WithTextLayout(true), WithBitSize(16))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer reader2.Close()
+
+	if _, err = Open("test/modes.db", WithMode(ModeExclusive), WithTextLayout(true), WithBitSize(16)); err != ErrLocked {
+		t.Error("expected ErrLocked for a writer while readers are open, got", err)
+	}
+
+	table, err = reader1.GetTable("Users")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if row, err := table.GetRow("user:1"); err != nil || row.Value != "User 1" {
+		t.Error("expected to read user:1 in read only mode", err)
+	}
+	if _, err = table.AddRow("user:2", "User 2"); err != ErrReadOnly {
+		t.Error("expected ErrReadOnly, got", err)
+	}
+	if _, err = reader1.AddTable("Other"); err != ErrReadOnly {
+		t.Error("expected ErrReadOnly, got", err)
+	}
+}
+
+func TestSharedMode(t *testing.T){
+	os.Remove("test/shared.db")
+	os.Remove("test/shared.changes")
+
+	// each Database has its own file, so they lock each other out like two processes would
+	db1, err := Open("test/shared.db", WithMode(ModeShared), WithTextLayout(true), WithBitSize(16))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer db1.Close()
+
+	db2, err := Open("test/shared.db", WithMode(ModeShared), WithTextLayout(true), WithBitSize(16))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer db2.Close()
+
+	table1, _ := db1.AddTable("Users")
+	table1.AddRow("user:1", "User 1")
+
+	table2, err := db2.GetTable("Users")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	// each database sees the rows added by the other one
+	table1.AddRow("user:2", "User 2")
+	if n, _ := table2.Count(); n != 2 {
+		t.Error("expected 2 rows after a change from another database, got", n)
+	}
+
+	table2.AddRow("user:3", "User 3")
+	if n, _ := table1.Count(); n != 3 {
+		t.Error("expected 3 rows after a change from another database, got", n)
+	}
+	if row, err := table1.GetRow("user:3"); err != nil || row.Value != "User 3" {
+		t.Error("expected to read a row added by another database", err)
+	}
+
+	// a write waits for the other database to release its lock
+	db1.mu.Lock()
+	ctx, cancel := context.WithTimeout(context.Background(), 50 * time.Millisecond)
+	if _, err = table2.GetRowContext(ctx, "user:1"); err != context.DeadlineExceeded {
+		t.Error("expected to give up waiting for the file lock, got", err)
+	}
+	cancel()
+
+	done := make(chan bool)
+	go func(){
+		table2.AddRow("user:4", "User 4")
+		done <- true
+	}()
+	select {
+	case <-done:
+		t.Error("expected the write to wait for the file lock")
+	case <-time.After(50 * time.Millisecond):
+	}
+	db1.mu.Unlock()
+	<-done
+
+	if n, _ := table1.Count(); n != 4 {
+		t.Error("expected 4 rows after the write finished, got", n)
+	}
+
+	// a handle to a block that another database freed and reused is stale
+	row1, _ := table1.GetRow("user:4")
+	row2, _ := table2.GetRow("user:4")
+	row2.Del()
+	reused, _ := table2.AddRow("user:5", "User 5")
+	if reused.line != row1.line {
+		t.Error("expected the freed block to be reused")
+	}
+	if err = row1.SetValue("changed"); err != ErrStaleHandle {
+		t.Error("expected ErrStaleHandle after another database reused the block, got", err)
+	}
+	if row, err := table2.GetRow("user:5"); err != nil || row.Value != "User 5" {
+		t.Error("expected the row in the reused block to be unchanged, got", row.Value, err)
+	}
+
+	if err = db1.Optimize(); err == nil {
+		t.Error("expected Optimize to fail for a shared database")
+	}
+
+	table1.Del()
+	if _, err = table2.GetRow("user:1"); err != ErrTableDeleted {
+		t.Error("expected ErrTableDeleted after another database deleted the table, got", err)
+	}
+
+	// both databases continue the same change log sequence
+	if err = db1.EnableChangeLog(ChangeLogRetention{MaxEntries: 4}); err != nil {
+		t.Error(err)
+	}
+	if err = db2.EnableChangeLog(ChangeLogRetention{MaxEntries: 4}); err != nil {
+		t.Error(err)
+	}
+	db1.AddData("a", "1")
+	db2.AddData("b", "2")
+	db1.AddData("c", "3")
+
+	seqs := []uint64{}
+	db2.ReadChangeLog(0, func(entry ChangeLogEntry) bool {
+		seqs = append(seqs, entry.Seq)
+		return true
+	})
+	if len(seqs) != 3 || seqs[0] != 1 || seqs[1] != 2 || seqs[2] != 3 {
+		t.Error("expected seq 1, 2, 3 from both databases, got", seqs)
+	}
+
+	// a log rewritten by one database is used by the other one
+	for i := 0; i < 10; i++ {
+		db1.AddData("d"+strconv.Itoa(i), "4")
+	}
+	db2.AddData("e", "5")
+	if seq, _ := db1.ChangeLogSeq(); seq != 14 {
+		t.Error("expected seq 14 after the log was rewritten, got", seq)
+	}
+	last := ChangeLogEntry{}
+	db1.ReadChangeLog(0, func(entry ChangeLogEntry) bool {
+		last = entry
+		return true
+	})
+	if last.Seq != 14 || last.Key != "e" {
+		t.Error("expected the latest entry from the other database, got", last.Seq, last.Key)
+	}
+}
+
+func TestOptions(t *testing.T){
+	os.Remove("test/options-text.db")
+	os.Remove("test/options-bin.db")
+
+	// both databases are open in the same process, with different layouts
+	textDB, err := Open("test/options-text.db", WithTextLayout(true), WithCompression(false), WithBitSize(16))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer textDB.Close()
+
+	binDB, err := Open("test/options-bin.db", WithKey([]byte("key123")), WithSyncPolicy(SyncEveryWrite))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer binDB.Close()
+
+	if textDB.bitSize != 16 || binDB.bitSize != 128 {
+		t.Error("expected bit sizes of 16 and 128, got", textDB.bitSize, binDB.bitSize)
+	}
+
+	for _, db := range []*Database{textDB, binDB} {
+		table, err := db.AddTable("Users")
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		table.AddRow("user:1", "a value that is long enough to need a few blocks")
+
+		if row, err := table.GetRow("user:1"); err != nil || row.Value != "a value that is long enough to need a few blocks" {
+			t.Error("expected to read user:1", err)
+		}
+	}
+
+	if buf, err := os.ReadFile("test/options-text.db"); err != nil || !bytes.Contains(buf, []byte(" few blocks")) || bytes.Count(buf, []byte{'\n'}) != len(buf) / 16 {
+		t.Error("expected the text layout to store one block per line, without compression", err)
+	}
+	if buf, err := os.ReadFile("test/options-bin.db"); err != nil || bytes.Contains(buf, []byte(" few blocks")) || bytes.Contains(buf, []byte{'\n'}) {
+		t.Error("expected the encrypted database to use the binary layout", err)
+	}
+}
+
+func TestLayout(t *testing.T){
+	os.Remove("test/layout-text.db")
+	os.Remove("test/layout-bin.db")
+
+	for _, opts := range [][]Option{
+		{WithTextLayout(true), WithCompression(false), WithBitSize(16)},
+		{WithTextLayout(false), WithCompression(true)},
+	} {
+		path := "test/layout-bin.db"
+		if len(opts) == 3 {
+			path = "test/layout-text.db"
+		}
+
+		db, err := Open(path, opts...)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		table, _ := db.AddTable("Users")
+		table.AddRow("user:1", "a value that is long enough to need a few blocks")
+		db.Close()
+	}
+
+	// the layout is read from the header, no matter which options or global setting are used
+	check := func(path string, textLayout bool, compress bool, opts ...Option){
+		db, err := Open(path, opts...)
+		if err != nil {
+			t.Error(path, err)
+			return
+		}
+		defer db.Close()
+
+		if db.textLayout != textLayout || db.compress != compress {
+			t.Error(path, "expected the layout from the header, got", db.textLayout, db.compress)
+		}
+
+		table, err := db.GetTable("Users")
+		if err != nil {
+			t.Error(path, err)
+			return
+		}
+		if row, err := table.GetRow("user:1"); err != nil || row.Value != "a value that is long enough to need a few blocks" {
+			t.Error(path, "expected to read user:1", err)
+		}
+	}
+
+	check("test/layout-text.db", true, false)
+	check("test/layout-bin.db", false, true, WithTextLayout(true), WithCompression(false))
+
+	DebugMode = true
+	check("test/layout-bin.db", false, true)
+	DebugMode = false
+
+	// files from older versions do not store the layout in the header
+	for _, path := range []string{"test/layout-text.db", "test/layout-bin.db"} {
+		file, err := os.OpenFile(path, os.O_RDWR, 0755)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		file.WriteAt([]byte{'-'}, layoutFlagPos)
+		file.Close()
+	}
+
+	check("test/layout-text.db", true, false)
+	check("test/layout-bin.db", false, true, WithTextLayout(true))
+}
+
+func TestStorage(t *testing.T){
+	mem := NewMemoryStorage()
+
+	db, err := Open("", WithStorage(mem), WithTextLayout(true), WithBitSize(16))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	table, _ := db.AddTable("Users")
+	for i := 0; i < 10; i++ {
+		table.AddRow("user:"+strconv.Itoa(i), "a value that is long enough to need a few blocks "+strconv.Itoa(i))
+	}
+	if row, err := table.GetRow("user:3"); err == nil {
+		row.Del()
+	}
+	db.AddData("key", "value")
+
+	if err = db.EnableChangeLog(ChangeLogRetention{}); err == nil {
+		t.Error("expected the change log to need a path")
+	}
+
+	// the storage cannot be replaced, so it is left as it was
+	size, _ := mem.Size()
+	if err = db.Optimize(); err == nil {
+		t.Error("expected Optimize to fail for a custom storage")
+	}
+	if newSize, _ := mem.Size(); newSize != size {
+		t.Error("expected Optimize to leave the memory at", size, "got", newSize)
+	}
+
+	snap, err := db.Snapshot()
+	if err != nil {
+		t.Error(err)
+	}
+	table, _ = db.GetTable("Users")
+	table.AddRow("user:new", "New User")
+	if snapTable, err := snap.GetTable("Users"); err != nil {
+		t.Error(err)
+	}else if n, _ := snapTable.CountMatch(Any()); n != 9 {
+		t.Error("expected the snapshot to have 9 rows, got", n)
+	}
+	snap.Close()
+
+	db.Close()
+
+	// the data is still in memory, and the layout is read from the header
+	db, err = Open("", WithStorage(mem))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer db.Close()
+
+	table, err = db.GetTable("Users")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if n, _ := table.CountMatch(Any()); n != 10 {
+		t.Error("expected 10 rows after opening the memory again, got", n)
+	}
+	if row, err := table.GetRow("user:9"); err != nil || row.Value != "a value that is long enough to need a few blocks 9" {
+		t.Error("expected to read user:9", err)
+	}
+	if data, err := db.GetData("key"); err != nil || data.Value != "value" {
+		t.Error("expected to read the data", err)
+	}
+
+	if _, err = Open("", WithStorage(NewMemoryStorage()), WithMode(ModeExclusive)); err == nil {
+		t.Error("expected file locks to need a FileStorage")
+	}
+
+	os.Remove("test/storage.db")
+	os.MkdirAll("test", 0755)
+	file, err := os.OpenFile("test/storage.db", os.O_CREATE|os.O_RDWR, 0755)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	fileDB, err := Open("test/storage.db", WithStorage(FileStorage{file}), WithMode(ModeExclusive), WithTextLayout(true), WithBitSize(16))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer fileDB.Close()
+
+	if _, err = Open("test/storage.db", WithMode(ModeExclusive)); err != ErrLocked {
+		t.Error("expected ErrLocked for a FileStorage, got", err)
+	}
+
+	// with SyncEveryWrite, a failed sync is returned by the write
+	failing := &failingSync{MemoryStorage: NewMemoryStorage()}
+	syncDB, err := Open("", WithStorage(failing), WithSyncPolicy(SyncEveryWrite), WithTextLayout(true), WithBitSize(16))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	table, _ = syncDB.AddTable("Users")
+	failing.fail = true
+	if _, err = table.AddRow("user:1", "User 1"); err == nil {
+		t.Error("expected AddRow to return the sync error")
+	}
+	if err = table.SetColumns([]Column{{Name: "name", Type: ColString}}); err == nil {
+		t.Error("expected SetColumns to return the sync error")
+	}
+	if _, err = table.GetRow("user:1"); err != nil {
+		t.Error("expected a read to not sync", err)
+	}
+	failing.fail = false
+	syncDB.Close()
+}
+
+// failingSync is a storage that returns an error from Sync while fail is true
+type failingSync struct {
+	*MemoryStorage
+	fail bool
+}
+
+func (s *failingSync) Sync() error {
+	if s.fail {
+		return errors.New("sync failed")
+	}
+	return s.MemoryStorage.Sync()
+}
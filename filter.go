@@ -0,0 +1,167 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"strconv"
+)
+
+// Filter returns the rows where fn returns true
+//
+// fn is called with the key and value of each row while the table is being scanned,
+// which avoids building a full list of rows with FindRows and filtering it afterwards
+//
+// @limit stops the scan after this many rows have been found (0 = no limit)
+func (table *Table) Filter(fn func(key []byte, value []byte) bool, limit int, noLock ...bool) ([]*Row, error) {
+	return table.FilterContext(context.Background(), fn, limit, noLock...)
+}
+
+// FilterContext is the same as Filter, but gives up waiting for the database lock,
+// and stops scanning, once the context is done
+func (table *Table) FilterContext(ctx context.Context, fn func(key []byte, value []byte) bool, limit int, noLock ...bool) ([]*Row, error) {
+	resRow := []*Row{}
+
+	err := table.FilterEachContext(ctx, fn, func(row *Row) bool {
+		resRow = append(resRow, row)
+		return limit <= 0 || len(resRow) < limit
+	}, noLock...)
+	if err != nil {
+		return resRow, err
+	}
+
+	if len(resRow) == 0 {
+		return resRow, io.EOF
+	}
+
+	return resRow, nil
+}
+
+// FilterEach calls each for every row where fn returns true, until each returns false
+//
+// note: the database stays locked until the scan finishes,
+// so each should pass noLock to any table methods it calls
+func (table *Table) FilterEach(fn func(key []byte, value []byte) bool, each func(row *Row) bool, noLock ...bool) error {
+	return table.FilterEachContext(context.Background(), fn, each, noLock...)
+}
+
+// FilterEachContext is the same as FilterEach, but gives up waiting for the database lock,
+// and stops scanning, once the context is done
+func (table *Table) FilterEachContext(ctx context.Context, fn func(key []byte, value []byte) bool, each func(row *Row) bool, noLock ...bool) error {
+	if len(noLock) == 0 || noLock[0] == false {
+		if err := table.db.rlockContext(ctx); err != nil {
+			return err
+		}
+		defer table.db.mu.RUnlock()
+	}
+
+	return table.eachRow(ctx, fn, each)
+}
+
+// FilterData returns the key value pairs where fn returns true
+//
+// @limit stops the scan after this many pairs have been found (0 = no limit)
+func (db *Database) FilterData(fn func(key []byte, value []byte) bool, limit int, noLock ...bool) ([]*Data, error) {
+	return db.FilterDataContext(context.Background(), fn, limit, noLock...)
+}
+
+// FilterDataContext is the same as FilterData, but gives up waiting for the database lock,
+// and stops scanning, once the context is done
+func (db *Database) FilterDataContext(ctx context.Context, fn func(key []byte, value []byte) bool, limit int, noLock ...bool) ([]*Data, error) {
+	resData := []*Data{}
+
+	err := db.FilterDataEachContext(ctx, fn, func(data *Data) bool {
+		resData = append(resData, data)
+		return limit <= 0 || len(resData) < limit
+	}, noLock...)
+	if err != nil {
+		return resData, err
+	}
+
+	if len(resData) == 0 {
+		return resData, io.EOF
+	}
+
+	return resData, nil
+}
+
+// FilterDataEach calls each for every key value pair where fn returns true, until each returns false
+//
+// note: the database stays locked until the scan finishes,
+// so each should pass noLock to any database methods it calls
+func (db *Database) FilterDataEach(fn func(key []byte, value []byte) bool, each func(data *Data) bool, noLock ...bool) error {
+	return db.FilterDataEachContext(context.Background(), fn, each, noLock...)
+}
+
+// FilterDataEachContext is the same as FilterDataEach, but gives up waiting for the database lock,
+// and stops scanning, once the context is done
+func (db *Database) FilterDataEachContext(ctx context.Context, fn func(key []byte, value []byte) bool, each func(data *Data) bool, noLock ...bool) error {
+	if len(noLock) == 0 || noLock[0] == false {
+		if err := db.rlockContext(ctx); err != nil {
+			return err
+		}
+		defer db.mu.RUnlock()
+	}
+
+	return db.eachData(ctx, fn, each)
+}
+
+
+// eachRow calls each for every row in the table accepted by match, until each returns false
+//
+// the database lock must already be held by the caller
+func (table *Table) eachRow(ctx context.Context, match func(key []byte, val []byte) bool, each func(row *Row) bool) error {
+	if err := table.checkDeleted(); err != nil {
+		return err
+	}
+
+	rowList := bytes.Split(table.val, []byte{','})
+	for _, rowLine := range rowList {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		if line, err := strconv.ParseInt(string(rowLine), 36, 64); err == nil {
+			table.db.file.Seek(line * int64(table.db.bitSize), io.SeekStart)
+			if row, err := scanDataObj(ctx, table.db, ':', table.rowMatch(match), true); err == nil {
+				newRow := table.rowFromObj(row)
+
+				//todo: add row to table cache
+
+				if !each(newRow) {
+					return nil
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// eachData calls each for every key value pair accepted by match, until each returns false
+//
+// the database lock must already be held by the caller
+func (db *Database) eachData(ctx context.Context, match func(key []byte, val []byte) bool, each func(data *Data) bool) error {
+	db.file.Seek(0, io.SeekStart)
+	for {
+		data, err := scanDataObj(ctx, db, '~', match)
+		if err == context.Canceled || err == context.DeadlineExceeded {
+			return err
+		}else if err != nil {
+			break
+		}
+
+		newData := db.dataFromObj(data)
+
+		//todo: add data to cache
+
+		// each may move the file position, so continue scanning after this object
+		pos := (data.line + 1) * int64(db.bitSize)
+		if !each(newData) {
+			return nil
+		}
+		db.file.Seek(pos, io.SeekStart)
+	}
+
+	return nil
+}
@@ -0,0 +1,19 @@
+//go:build !unix
+
+package db
+
+import (
+	"os"
+)
+
+// lockFile takes an advisory lock on the file
+//
+// advisory locks are only supported on unix systems, so this does nothing
+func lockFile(file *os.File, exclusive bool, wait bool) error {
+	return nil
+}
+
+// unlockFile releases the advisory lock on the file
+func unlockFile(file *os.File) error {
+	return nil
+}
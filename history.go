@@ -0,0 +1,365 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"strconv"
+	"time"
+)
+
+// Versioning controls how many previous values are kept for each row of a table
+//
+// versions are removed when either limit is reached (0 = no limit)
+type Versioning struct {
+	MaxVersions int `json:"maxVersions,omitempty"`
+	MaxAge time.Duration `json:"maxAge,omitempty"`
+}
+
+// RowVersion is a previous value of a row
+type RowVersion struct {
+	Value string
+
+	// From is when the value was written (zero if it was written before versioning was enabled)
+	From time.Time
+
+	// To is when the value was replaced
+	To time.Time
+}
+
+// rowHistory is stored in a '^' object, which the row header points to
+type rowHistory struct {
+	// current is when the current value of the row was written, in unix milliseconds
+	current int64
+	versions []historyVersion
+}
+
+// historyVersion is a previous value of a row, stored as the row data (and header) it had
+type historyVersion struct {
+	start int64
+	end int64
+	data []byte
+}
+
+// SetVersioning enables history for the rows of the table
+//
+// once enabled, every change to the value of a row keeps its previous value,
+// which can be read with Row.History and Table.GetRowAt
+//
+// @versioning nil stops recording new versions, but keeps the history that was already recorded
+func (table *Table) SetVersioning(versioning *Versioning, noLock ...bool) error {
+	if len(noLock) == 0 || noLock[0] == false {
+		table.db.mu.Lock()
+		defer table.db.mu.Unlock()
+	}
+
+	if err := table.checkDeleted(); err != nil {
+		return err
+	}
+
+	if versioning != nil {
+		v := *versioning
+		versioning = &v
+	}
+
+	oldVersioning := table.meta.Versioning
+	table.meta.Versioning = versioning
+
+	table.db.file.Seek(table.line * int64(table.db.bitSize), io.SeekStart)
+	if _, err := setDataObj(table.db, '$', table.key, table.encodeVal()); err != nil {
+		table.meta.Versioning = oldVersioning
+		return err
+	}
+
+	return table.db.syncWrite(nil)
+}
+
+// Versioning returns the versioning settings of the table, or nil if it does not keep history
+func (table *Table) Versioning() *Versioning {
+	if table.meta.Versioning == nil {
+		return nil
+	}
+	v := *table.meta.Versioning
+	return &v
+}
+
+// History returns the previous values of the row, from oldest to newest
+func (row *Row) History(noLock ...bool) ([]RowVersion, error) {
+	if len(noLock) == 0 || noLock[0] == false {
+		row.table.db.mu.RLock()
+		defer row.table.db.mu.RUnlock()
+	}
+
+	if err := row.checkStale(); err != nil {
+		return nil, err
+	}
+
+	current, err := row.stored(context.Background())
+	if err != nil {
+		return nil, err
+	}
+
+	hist, err := row.table.readHistory(current.header.history)
+	if err != nil {
+		return nil, err
+	}
+
+	res := make([]RowVersion, 0, len(hist.versions))
+	for _, version := range hist.versions {
+		past := row.table.versionRow(current, version)
+
+		v := RowVersion{
+			Value: past.Value,
+			To: time.UnixMilli(version.end),
+		}
+		if version.start != 0 {
+			v.From = time.UnixMilli(version.start)
+		}
+
+		res = append(res, v)
+	}
+
+	return res, nil
+}
+
+// GetRowAt retrieves a row from the table, with the value it had at a specific time
+//
+// the returned row is still a handle to the current row, so SetValue will change the current value
+//
+// an error is returned if the row did not exist yet, or its version at that time is no longer kept
+func (table *Table) GetRowAt(key string, at time.Time, noLock ...bool) (*Row, error) {
+	if len(noLock) == 0 || noLock[0] == false {
+		table.db.mu.RLock()
+		defer table.db.mu.RUnlock()
+	}
+
+	row, err := table.GetRowContext(context.Background(), key, true)
+	if err != nil {
+		return row, err
+	}
+
+	if row.header.history == 0 {
+		// the row has never been versioned
+		return row, nil
+	}
+
+	hist, err := table.readHistory(row.header.history)
+	if err != nil {
+		return &Row{table: table}, err
+	}
+
+	atMilli := at.UnixMilli()
+	if atMilli >= hist.current {
+		return row, nil
+	}
+
+	for i := len(hist.versions)-1; i >= 0; i-- {
+		version := hist.versions[i]
+		if atMilli >= version.start && atMilli < version.end {
+			return table.versionRow(row, version), nil
+		}
+	}
+
+	if len(hist.versions) == 0 || hist.versions[0].start != 0 && atMilli < hist.versions[0].start {
+		return &Row{table: table}, errors.New("row did not exist at that time, or its version is no longer kept")
+	}
+	return &Row{table: table}, errors.New("row version at that time is no longer kept")
+}
+
+// versionRow returns a copy of a row, with the value of a previous version
+func (table *Table) versionRow(row *Row, version historyVersion) *Row {
+	past := table.rowFromObj(dbObj{
+		key: []byte(row.Key),
+		val: version.data,
+		line: row.line,
+	})
+
+	// keep the current header, so writing to the row keeps its history and expiration
+	columns := past.header.columns
+	past.header = row.header
+	past.header.columns = columns
+	past.gen = row.gen
+
+	return past
+}
+
+// newHistory adds a history object for a new row, and returns its line
+func (table *Table) newHistory(keyB []byte) (int64, error) {
+	hist := rowHistory{current: time.Now().UnixMilli()}
+
+	obj, err := addDataObj(table.db, '^', keyB, hist.encode())
+	if err != nil {
+		return 0, err
+	}
+	return obj.line, nil
+}
+
+// pushHistory stores the current value of the row as a previous version, before it is changed
+//
+// if the table does not keep history, this method does nothing
+//
+// the database lock must already be held by the caller
+func (row *Row) pushHistory() error {
+	versioning := row.table.meta.Versioning
+	if versioning == nil {
+		return nil
+	}
+
+	// the handle may not have the latest value, so the stored value is read again
+	obj, err := readObjAt(row.table.db, ':', row.line)
+	if err != nil {
+		return err
+	}
+
+	header, data := decodeRowVal(obj.val)
+	histLine := header.history
+	header.history = 0
+	oldData := encodeRowVal(header, data)
+
+	now := time.Now().UnixMilli()
+
+	keyB := []byte(row.Key)
+
+	var hist rowHistory
+	if histLine != 0 {
+		if hist, err = row.table.readHistory(histLine); err != nil {
+			histLine = 0
+		}
+	}
+
+	hist.versions = append(hist.versions, historyVersion{
+		start: hist.current,
+		end: now,
+		data: oldData,
+	})
+	hist.current = now
+
+	if versioning.MaxVersions > 0 && len(hist.versions) > versioning.MaxVersions {
+		hist.versions = hist.versions[len(hist.versions)-versioning.MaxVersions:]
+	}
+	if versioning.MaxAge > 0 {
+		minTime := now - versioning.MaxAge.Milliseconds()
+		for len(hist.versions) != 0 && hist.versions[0].end < minTime {
+			hist.versions = hist.versions[1:]
+		}
+	}
+
+	if histLine == 0 {
+		obj, err := addDataObj(row.table.db, '^', keyB, hist.encode())
+		if err != nil {
+			return err
+		}
+		histLine = obj.line
+	}else{
+		row.table.db.file.Seek(histLine * int64(row.table.db.bitSize), io.SeekStart)
+		if _, err := setDataObj(row.table.db, '^', keyB, hist.encode()); err != nil {
+			return err
+		}
+	}
+
+	row.header.history = histLine
+	return nil
+}
+
+// readHistory reads the history object of a row
+func (table *Table) readHistory(line int64) (rowHistory, error) {
+	if line == 0 {
+		return rowHistory{}, nil
+	}
+
+	obj, err := readObjAt(table.db, '^', line)
+	if err != nil {
+		return rowHistory{}, errors.New("row history is missing")
+	}
+
+	return decodeHistory(obj.val), nil
+}
+
+// delRow removes the row at a line, and its history
+func (table *Table) delRow(line int64, header rowHeader) (dbObj, error) {
+	table.db.file.Seek(line * int64(table.db.bitSize), io.SeekStart)
+	obj, err := delDataObj(table.db, ':')
+
+	if header.history != 0 {
+		if _, e := readObjAt(table.db, '^', header.history); e == nil {
+			table.db.file.Seek(header.history * int64(table.db.bitSize), io.SeekStart)
+			delDataObj(table.db, '^')
+		}
+	}
+
+	return obj, err
+}
+
+// readObjAt reads the object at a line, only if it has the expected prefix
+func readObjAt(db *Database, prefix byte, line int64) (dbObj, error) {
+	buf := make([]byte, 1)
+	if _, err := db.file.ReadAt(buf, line * int64(db.bitSize)); err != nil {
+		return dbObj{}, err
+	}else if buf[0] != prefix {
+		return dbObj{}, io.EOF
+	}
+
+	db.file.Seek(line * int64(db.bitSize), io.SeekStart)
+	return scanDataObj(context.Background(), db, prefix, func(key, val []byte) bool {
+		return true
+	}, true)
+}
+
+// encode encodes the history as "<current>" followed by "|<start>,<end>,<data length>:<data>" for each version, with base36 numbers
+func (hist rowHistory) encode() []byte {
+	res := []byte(strconv.FormatInt(hist.current, 36))
+	for _, version := range hist.versions {
+		res = append(res, '|')
+		res = append(res, strconv.FormatInt(version.start, 36)...)
+		res = append(res, ',')
+		res = append(res, strconv.FormatInt(version.end, 36)...)
+		res = append(res, ',')
+		res = append(res, strconv.FormatInt(int64(len(version.data)), 36)...)
+		res = append(res, ':')
+		res = append(res, version.data...)
+	}
+	return res
+}
+
+// decodeHistory decodes the history stored by rowHistory.encode
+func decodeHistory(buf []byte) rowHistory {
+	hist := rowHistory{}
+
+	i := bytes.IndexByte(buf, '|')
+	if i == -1 {
+		i = len(buf)
+	}
+	hist.current, _ = strconv.ParseInt(string(buf[:i]), 36, 64)
+	buf = buf[i:]
+
+	for len(buf) != 0 && buf[0] == '|' {
+		buf = buf[1:]
+
+		i := bytes.IndexByte(buf, ':')
+		if i == -1 {
+			break
+		}
+
+		nums := bytes.Split(buf[:i], []byte{','})
+		if len(nums) != 3 {
+			break
+		}
+
+		start, err1 := strconv.ParseInt(string(nums[0]), 36, 64)
+		end, err2 := strconv.ParseInt(string(nums[1]), 36, 64)
+		size, err3 := strconv.ParseInt(string(nums[2]), 36, 64)
+		if err1 != nil || err2 != nil || err3 != nil || size < 0 || int64(len(buf)-i-1) < size {
+			break
+		}
+
+		hist.versions = append(hist.versions, historyVersion{
+			start: start,
+			end: end,
+			data: buf[i+1:i+1+int(size)],
+		})
+		buf = buf[i+1+int(size):]
+	}
+
+	return hist
+}
@@ -0,0 +1,95 @@
+package db
+
+import (
+	"sync"
+)
+
+// hookList holds the hooks registered on a database
+type hookList struct {
+	mu sync.RWMutex
+	before map[string][]func(change Change) error
+	after map[string][]func(change Change)
+}
+
+// BeforeWrite adds a hook that runs before every write to a table, its rows, or a key value pair
+//
+// @table limits the hook to a single table ("" = every write, including key value pairs)
+//
+// the hook can return an error to cancel the write, and that error will be returned by the write method
+//
+// hooks run inside the database lock, so they see a consistent view of the database,
+// but any method they call on the database must set noLock to true
+//
+// note: expired rows removed by ReapExpired, or replaced by AddRow, cannot be canceled, since they are already treated as missing
+func (db *Database) BeforeWrite(table string, hook func(change Change) error) {
+	db.hooks.mu.Lock()
+	defer db.hooks.mu.Unlock()
+
+	if db.hooks.before == nil {
+		db.hooks.before = map[string][]func(change Change) error{}
+	}
+	db.hooks.before[table] = append(db.hooks.before[table], hook)
+}
+
+// AfterWrite adds a hook that runs after every write to a table, its rows, or a key value pair
+//
+// @table limits the hook to a single table ("" = every write, including key value pairs)
+//
+// like BeforeWrite, hooks run inside the database lock, and must set noLock to true
+func (db *Database) AfterWrite(table string, hook func(change Change)) {
+	db.hooks.mu.Lock()
+	defer db.hooks.mu.Unlock()
+
+	if db.hooks.after == nil {
+		db.hooks.after = map[string][]func(change Change){}
+	}
+	db.hooks.after[table] = append(db.hooks.after[table], hook)
+}
+
+// beforeWrite runs the before hooks for a change, and returns the first error
+//
+// it also returns ErrReadOnly if the database cannot be changed
+//
+// the database lock must already be held by the caller
+func (db *Database) beforeWrite(change Change) error {
+	if err := db.checkWritable(); err != nil {
+		return err
+	}
+
+	db.hooks.mu.RLock()
+	hooks := append([]func(change Change) error{}, db.hooks.before[""]...)
+	if change.Table != "" {
+		hooks = append(hooks, db.hooks.before[change.Table]...)
+	}
+	if change.OldTable != "" && change.OldTable != change.Table {
+		hooks = append(hooks, db.hooks.before[change.OldTable]...)
+	}
+	db.hooks.mu.RUnlock()
+
+	for _, hook := range hooks {
+		if err := hook(change); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// afterWrite runs the after hooks for a change
+//
+// the database lock must already be held by the caller
+func (db *Database) afterWrite(change Change) {
+	db.hooks.mu.RLock()
+	hooks := append([]func(change Change){}, db.hooks.after[""]...)
+	if change.Table != "" {
+		hooks = append(hooks, db.hooks.after[change.Table]...)
+	}
+	if change.OldTable != "" && change.OldTable != change.Table {
+		hooks = append(hooks, db.hooks.after[change.OldTable]...)
+	}
+	db.hooks.mu.RUnlock()
+
+	for _, hook := range hooks {
+		hook(change)
+	}
+}
@@ -0,0 +1,43 @@
+package db
+
+// the file header starts with "#bit=", followed by the bit size in base36, padded with '-' to 9 bytes,
+// and then a byte with the layout flags of the file
+//
+// files from older versions have a '-' instead of the flags,
+// and used a text layout without compression, or a binary layout with compression
+const (
+	layoutFlagPos = 9
+
+	// layoutText ends each block with a newline
+	layoutText byte = 1
+
+	// layoutRaw stores data without compression
+	layoutRaw byte = 2
+)
+
+// layoutFlag returns the header byte for a layout
+func layoutFlag(textLayout bool, compress bool) byte {
+	var flags byte
+	if textLayout {
+		flags |= layoutText
+	}
+	if !compress {
+		flags |= layoutRaw
+	}
+	return '0' + flags
+}
+
+// parseLayoutFlag reads the layout from a header byte
+//
+// @legacyText is used for files from older versions, which did not store the layout,
+// and is true if the header block ends with a newline
+func parseLayoutFlag(b byte, legacyText bool) (textLayout bool, compress bool, ok bool) {
+	if b == '-' {
+		return legacyText, !legacyText, true
+	}else if b < '0' || b > '0' + (layoutText | layoutRaw) {
+		return false, false, false
+	}
+
+	flags := b - '0'
+	return flags & layoutText != 0, flags & layoutRaw == 0, true
+}
@@ -0,0 +1,176 @@
+package db
+
+import (
+	"bytes"
+
+	"github.com/AspieSoft/go-regex-re2/v2"
+)
+
+const (
+	matchAny uint8 = iota
+	matchExact
+	matchPrefix
+	matchSuffix
+	matchGlob
+	matchRegex
+)
+
+// Matcher describes how a key or value should be compared when searching the database
+//
+// unlike the leading 0 byte convention used by FindRows, FindTables and FindData,
+// a Matcher will never run regex unless it was built with the Regex method,
+// so it is safe to build one from user input
+type Matcher struct {
+	kind uint8
+	val []byte
+	re *regex.Regexp
+	fold bool
+	err error
+}
+
+// Any matches every key or value
+func Any() Matcher {
+	return Matcher{kind: matchAny}
+}
+
+// Exact matches a key or value that is exactly equal to str
+func Exact(str string) Matcher {
+	return Matcher{kind: matchExact, val: []byte(str)}
+}
+
+// Prefix matches a key or value that starts with str
+func Prefix(str string) Matcher {
+	return Matcher{kind: matchPrefix, val: []byte(str)}
+}
+
+// Suffix matches a key or value that ends with str
+func Suffix(str string) Matcher {
+	return Matcher{kind: matchSuffix, val: []byte(str)}
+}
+
+// Glob matches a key or value against a simple wildcard pattern
+//
+// '*' matches any number of characters, and '?' matches a single character
+//
+// you can escape a wildcard with a '\' to match it literally
+func Glob(pattern string) Matcher {
+	return Matcher{kind: matchGlob, val: []byte(pattern)}
+}
+
+// Regex matches a key or value against an RE2 regular expression
+//
+// if the pattern fails to compile, the find method it is passed to will return the error
+func Regex(pattern string) Matcher {
+	re, err := regex.CompTry(escapeRegexParams([]byte(pattern)))
+	return Matcher{kind: matchRegex, val: []byte(pattern), re: re, err: err}
+}
+
+// CaseInsensitive returns a copy of a matcher that ignores letter case
+func CaseInsensitive(m Matcher) Matcher {
+	m.fold = true
+	if m.kind == matchRegex && m.err == nil {
+		m.re, m.err = regex.CompTry("(?i)" + escapeRegexParams(m.val))
+	}
+	return m
+}
+
+// Match reports whether b is matched by the matcher
+func (m Matcher) Match(b []byte) bool {
+	if m.err != nil {
+		return false
+	}
+
+	switch m.kind {
+	case matchAny:
+		return true
+	case matchRegex:
+		return m.re.Match(b)
+	}
+
+	val := m.val
+	if m.fold {
+		b = bytes.ToLower(b)
+		val = bytes.ToLower(val)
+	}
+
+	switch m.kind {
+	case matchExact:
+		return bytes.Equal(b, val)
+	case matchPrefix:
+		return bytes.HasPrefix(b, val)
+	case matchSuffix:
+		return bytes.HasSuffix(b, val)
+	case matchGlob:
+		return globMatch(val, b)
+	}
+
+	return false
+}
+
+// legacyMatcher converts the leading 0 byte search convention into a Matcher
+//
+// a first byte of 0 followed by nothing, or a '*', will match anything,
+// and a first byte of 0 followed by anything else will run an RE2 regex match
+func legacyMatcher(b []byte) Matcher {
+	if len(b) == 0 || b[0] != 0 {
+		return Matcher{kind: matchExact, val: b}
+	}
+
+	b = b[1:]
+	if len(b) == 0 || (len(b) == 1 && b[0] == '*') {
+		return Any()
+	}
+
+	re, err := regex.CompTry(escapeRegexParams(b))
+	return Matcher{kind: matchRegex, val: b, re: re, err: err}
+}
+
+// escapeRegexParams escapes the '%' params used by the regex module, so they are matched literally
+func escapeRegexParams(re []byte) string {
+	return string(regex.Comp(`(\\*)([\\\%])`).RepFunc(re, func(data func(int) []byte) []byte {
+		if l := len(data(1)); (l == 0 || l % 2 == 0) && data(2)[0] != '\\' {
+			return regex.JoinBytes(data(1), '\\', data(2))
+		}
+		return data(0)
+	}))
+}
+
+// globMatch matches b against a pattern with '*' and '?' wildcards
+func globMatch(pattern []byte, b []byte) bool {
+	p, i := 0, 0
+	starP, starI := -1, 0
+
+	for i < len(b) {
+		if p < len(pattern) && pattern[p] == '\\' && p+1 < len(pattern) {
+			if pattern[p+1] == b[i] {
+				p += 2
+				i++
+				continue
+			}
+		}else if p < len(pattern) && pattern[p] == '*' {
+			starP = p
+			starI = i
+			p++
+			continue
+		}else if p < len(pattern) && (pattern[p] == '?' || pattern[p] == b[i]) {
+			p++
+			i++
+			continue
+		}
+
+		if starP == -1 {
+			return false
+		}
+
+		// backtrack to the last '*' and let it consume one more character
+		starI++
+		i = starI
+		p = starP + 1
+	}
+
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+
+	return p == len(pattern)
+}
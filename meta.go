@@ -0,0 +1,229 @@
+package db
+
+import (
+	"bytes"
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"github.com/AspieSoft/go-regex-re2/v2"
+)
+
+// tableMeta holds the settings of a table
+//
+// it is stored in the value of the '$' table object, after the row list and a ';'
+type tableMeta struct {
+	Columns []Column `json:"columns,omitempty"`
+	Schema *Schema `json:"schema,omitempty"`
+	Versioning *Versioning `json:"versioning,omitempty"`
+}
+
+// rowHeader holds the settings of a row
+//
+// a row value that starts with a 0 byte has a header, followed by another 0 byte, and then the row data
+//
+// the string methods always trim a leading 0 from values,
+// so a value with a header cannot be confused with a value that was added without one
+type rowHeader struct {
+	// columns is true if the row data holds named columns, instead of a single value
+	columns bool
+
+	// expire is the unix time in milliseconds when the row expires (0 = never)
+	expire int64
+
+	// history is the line of the '^' object that holds the previous values of the row (0 = none)
+	history int64
+}
+
+// tableFromObj returns the table handle for a '$' object
+//
+// there is only one handle for each table, which is shared through the database cache,
+// so every caller sees the same row list, and a deleted table is seen as deleted by every caller
+//
+// the handle is refreshed from the object, since the stored table is always authoritative
+func tableFromObj(db *Database, obj dbObj) *Table {
+	lineKey := strconv.FormatInt(obj.line, 36)
+
+	table, ok := db.cache.Get(lineKey)
+	if ok && table.line == obj.line && table.gen == db.lineGen(obj.line) && bytes.Equal(table.key, obj.key) {
+		table.val, table.meta = decodeTableVal(obj.val)
+		return table
+	}else if ok {
+		// the block was reused by a different table
+		table.line = -1
+	}
+
+	table = &Table{
+		db: db,
+		Name: string(obj.key),
+		key: obj.key,
+		line: obj.line,
+		gen: db.lineGen(obj.line),
+	}
+
+	table.val, table.meta = decodeTableVal(obj.val)
+
+	db.cache.Set(lineKey, table)
+
+	return table
+}
+
+// decodeTableVal splits the value of a table object into its row list and metadata
+func decodeTableVal(val []byte) ([]byte, tableMeta) {
+	meta := tableMeta{}
+
+	i := bytes.IndexByte(val, ';')
+	if i == -1 {
+		return val, meta
+	}
+
+	json.Unmarshal(val[i+1:], &meta)
+
+	return val[:i], meta
+}
+
+// encodeVal returns the value of the table object, with its row list and metadata
+func (table *Table) encodeVal() []byte {
+	if table.meta.isEmpty() {
+		return table.val
+	}
+
+	buf, err := json.Marshal(table.meta)
+	if err != nil {
+		return table.val
+	}
+
+	return regex.JoinBytes(table.val, ';', buf)
+}
+
+func (meta tableMeta) isEmpty() bool {
+	return len(meta.Columns) == 0 && meta.Schema == nil && meta.Versioning == nil
+}
+
+// rowFromObj creates a row handle from a ':' object
+func (table *Table) rowFromObj(obj dbObj) *Row {
+	row := &Row{
+		table: table,
+		Key: string(obj.key),
+		line: obj.line,
+		gen: table.db.lineGen(obj.line),
+	}
+
+	var data []byte
+	row.header, data = decodeRowVal(obj.val)
+
+	if row.header.columns {
+		row.cols = decodeColumns(data)
+		row.Value = string(row.column(table.firstColumn()))
+	}else{
+		row.Value = string(data)
+	}
+
+	return row
+}
+
+// dataFromObj creates a key value pair handle from a '~' object
+func (db *Database) dataFromObj(obj dbObj) *Data {
+	return &Data{
+		db: db,
+		Key: string(obj.key),
+		Value: string(obj.val),
+		line: obj.line,
+		gen: db.lineGen(obj.line),
+	}
+}
+
+// rowMatch wraps a match function, so it is called with the value of a row instead of its stored data
+//
+// expired rows are treated as missing, and will never match
+func (table *Table) rowMatch(match func(key []byte, val []byte) bool) func(key []byte, val []byte) bool {
+	return func(key []byte, val []byte) bool {
+		header, data := table.rowData(val)
+		if header.expired() {
+			return false
+		}
+		return match(key, data)
+	}
+}
+
+// rowData decodes the stored data of a row into its header and value
+func (table *Table) rowData(val []byte) (rowHeader, []byte) {
+	header, data := decodeRowVal(val)
+	if header.columns {
+		data = columnValue(decodeColumns(data), table.firstColumn())
+	}
+	return header, data
+}
+
+// encodeVal returns the data that should be stored for the row
+func (row *Row) encodeVal() []byte {
+	if row.cols != nil {
+		row.header.columns = true
+		return encodeRowVal(row.header, encodeColumns(row.cols))
+	}
+
+	row.header.columns = false
+	return encodeRowVal(row.header, []byte(row.Value))
+}
+
+// decodeRowVal splits a stored row value into its header and data
+func decodeRowVal(val []byte) (rowHeader, []byte) {
+	header := rowHeader{}
+
+	if len(val) == 0 || val[0] != 0 {
+		return header, val
+	}
+
+	i := bytes.IndexByte(val[1:], 0)
+	if i == -1 {
+		// not a header, the value was added with a leading 0 byte
+		return header, val
+	}
+
+	for _, field := range bytes.Split(val[1:i+1], []byte{','}) {
+		if len(field) == 0 {
+			continue
+		}
+
+		switch field[0] {
+		case 'c':
+			header.columns = true
+		case 'e':
+			if exp, err := strconv.ParseInt(string(field[1:]), 36, 64); err == nil {
+				header.expire = exp
+			}
+		case 'h':
+			if line, err := strconv.ParseInt(string(field[1:]), 36, 64); err == nil {
+				header.history = line
+			}
+		}
+	}
+
+	return header, val[i+2:]
+}
+
+// expired reports whether the row has expired
+func (header rowHeader) expired() bool {
+	return header.expire != 0 && header.expire <= time.Now().UnixMilli()
+}
+
+// encodeRowVal joins a row header and its data into the value that should be stored
+func encodeRowVal(header rowHeader, data []byte) []byte {
+	fields := [][]byte{}
+
+	if header.columns {
+		fields = append(fields, []byte{'c'})
+	}
+	if header.expire != 0 {
+		fields = append(fields, append([]byte{'e'}, strconv.FormatInt(header.expire, 36)...))
+	}
+	if header.history != 0 {
+		fields = append(fields, append([]byte{'h'}, strconv.FormatInt(header.history, 36)...))
+	}
+
+	if len(fields) == 0 && (len(data) == 0 || data[0] != 0) {
+		return data
+	}
+
+	return regex.JoinBytes([]byte{0}, bytes.Join(fields, []byte{','}), []byte{0}, data)
+}
@@ -0,0 +1,113 @@
+package db
+
+// Option changes a setting of a database, when it is passed to Open
+type Option func(opts *options)
+
+type options struct {
+	encKey []byte
+	bitSize uint16
+	mode OpenMode
+	compress bool
+	textLayout bool
+	syncPolicy SyncPolicy
+	storage Storage
+}
+
+// SyncPolicy controls when changes are flushed from the file system to the disk
+type SyncPolicy uint8
+
+const (
+	// SyncOnClose only syncs the file when the database is closed or optimized (the default)
+	SyncOnClose SyncPolicy = iota
+
+	// SyncEveryWrite syncs the file after every operation that changes it
+	//
+	// this is much slower, but a change that was returned without an error will survive a power outage
+	SyncEveryWrite
+)
+
+// newOptions returns the default options, before any Option is applied
+//
+// DebugMode is still used as the default for the text layout and compression of a new file
+func newOptions() options {
+	return options{
+		mode: ModeReadWrite,
+		compress: !DebugMode,
+		textLayout: DebugMode,
+		syncPolicy: SyncOnClose,
+	}
+}
+
+// WithKey encrypts the data of the database with a key
+func WithKey(encKey []byte) Option {
+	return func(opts *options) {
+		opts.encKey = encKey
+	}
+}
+
+// WithBitSize tells the database what bit size to use (this value must always be consistent)
+//  - (default: 128)
+//  - (0 = default 128)
+//  - (min = 64)
+//  - (max = 64000)
+// note: with a text layout, (min = 16)
+func WithBitSize(bitSize uint16) Option {
+	return func(opts *options) {
+		opts.bitSize = bitSize
+	}
+}
+
+// WithMode chooses how the file is opened, and locked from other processes
+//
+// note: advisory locks are only supported on unix systems, and only stop other processes that also use a lock
+func WithMode(mode OpenMode) Option {
+	return func(opts *options) {
+		opts.mode = mode
+	}
+}
+
+// WithReadOnly is the same as WithMode(ModeReadOnly)
+func WithReadOnly() Option {
+	return WithMode(ModeReadOnly)
+}
+
+// WithCompression compresses the data of the database with smaz (default: true)
+//
+// data is never compressed when it is encrypted with WithKey
+//
+// note: this is only used for a new file, since an existing file keeps the layout stored in its header
+func WithCompression(enabled bool) Option {
+	return func(opts *options) {
+		opts.compress = enabled
+	}
+}
+
+// WithSyncPolicy chooses when changes are flushed to the disk (default: SyncOnClose)
+func WithSyncPolicy(policy SyncPolicy) Option {
+	return func(opts *options) {
+		opts.syncPolicy = policy
+	}
+}
+
+// WithTextLayout ends each block with a newline, so the file can be read in a text editor (default: false)
+//
+// this also allows a smaller bit size, and is useful for debugging
+//
+// note: this is only used for a new file, since an existing file keeps the layout stored in its header
+func WithTextLayout(enabled bool) Option {
+	return func(opts *options) {
+		opts.textLayout = enabled
+	}
+}
+
+// WithStorage keeps the database in a storage, instead of the file at the path passed to Open
+//
+// the path may be empty, unless the change log is used, and the database closes the storage when it is closed
+//
+// note: the advisory locks of ModeExclusive and ModeShared can only be used with a FileStorage,
+// and Optimize cannot be used with a storage
+func WithStorage(storage Storage) Option {
+	return func(opts *options) {
+		opts.storage = storage
+	}
+}
@@ -0,0 +1,511 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Query is a parsed query for the table and row model
+//
+// example: FROM MyTable WHERE key ~ "^user:" AND value > 10 ORDER BY key LIMIT 50
+type Query struct {
+	Table string
+	Where *QueryExpr
+	OrderBy string
+	Desc bool
+	Limit int
+}
+
+// QueryExpr is a node in the WHERE clause of a query
+//
+// And, Or and Not nodes use Left (and Right), and comparison nodes use Field, Op and Value
+type QueryExpr struct {
+	Op string
+	Field string
+	Value string
+	Left *QueryExpr
+	Right *QueryExpr
+
+	match Matcher
+}
+
+type queryToken struct {
+	kind uint8
+	val string
+	pos int
+}
+
+const (
+	tokEOF uint8 = iota
+	tokIdent
+	tokString
+	tokNumber
+	tokOp
+	tokOpen
+	tokClose
+)
+
+// Query parses and runs a query against the database
+//
+// query syntax:
+//  FROM <table> [WHERE <expr>] [ORDER BY key|value [ASC|DESC]] [LIMIT <n>]
+//
+// an <expr> compares a field (key or value) to a string or number,
+// and can be combined with AND, OR, NOT, and parentheses
+//
+// operators:
+//  - (=, !=) equal, not equal
+//  - (~, !~) RE2 regex match, no match
+//  - (>, >=, <, <=) numeric if both sides are numbers, otherwise compared as strings
+func (db *Database) Query(query string, noLock ...bool) ([]*Row, error) {
+	return db.QueryContext(context.Background(), query, noLock...)
+}
+
+// QueryContext is the same as Query, but gives up waiting for the database lock,
+// and stops scanning, once the context is done
+func (db *Database) QueryContext(ctx context.Context, query string, noLock ...bool) ([]*Row, error) {
+	q, err := ParseQuery(query)
+	if err != nil {
+		return []*Row{}, err
+	}
+
+	return q.Exec(ctx, db, noLock...)
+}
+
+// ParseQuery parses a query string without running it
+func ParseQuery(query string) (*Query, error) {
+	tokens, err := lexQuery(query)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &queryParser{tokens: tokens}
+	q := &Query{}
+
+	if !p.keyword("FROM") {
+		return nil, p.errorf("expected FROM")
+	}
+
+	if tok := p.next(); tok.kind == tokIdent || tok.kind == tokString {
+		q.Table = tok.val
+	}else{
+		return nil, p.errorAt(tok, "expected table name")
+	}
+
+	if p.keyword("WHERE") {
+		q.Where, err = p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if p.keyword("ORDER") {
+		if !p.keyword("BY") {
+			return nil, p.errorf("expected BY after ORDER")
+		}
+
+		tok := p.next()
+		field := strings.ToLower(tok.val)
+		if tok.kind != tokIdent || (field != "key" && field != "value") {
+			return nil, p.errorAt(tok, "expected key or value after ORDER BY")
+		}
+		q.OrderBy = field
+
+		if p.keyword("DESC") {
+			q.Desc = true
+		}else{
+			p.keyword("ASC")
+		}
+	}
+
+	if p.keyword("LIMIT") {
+		tok := p.next()
+		n, err := strconv.Atoi(tok.val)
+		if tok.kind != tokNumber || err != nil || n < 0 {
+			return nil, p.errorAt(tok, "expected a positive number after LIMIT")
+		}
+		q.Limit = n
+	}
+
+	if tok := p.peek(); tok.kind != tokEOF {
+		return nil, p.errorAt(tok, "unexpected '"+tok.val+"'")
+	}
+
+	return q, nil
+}
+
+// Exec runs a parsed query against a database
+//
+// if the WHERE clause requires the key to equal a string, the row is looked up directly by its key,
+// otherwise, the rows of the table are filtered while scanning
+func (q *Query) Exec(ctx context.Context, db *Database, noLock ...bool) ([]*Row, error) {
+	if len(noLock) == 0 || noLock[0] == false {
+		if err := db.rlockContext(ctx); err != nil {
+			return []*Row{}, err
+		}
+		defer db.mu.RUnlock()
+	}
+
+	table, err := db.GetTableContext(ctx, q.Table, true)
+	if err != nil {
+		return []*Row{}, err
+	}
+
+	resRow := []*Row{}
+
+	if key, ok := q.Where.exactKey(); ok {
+		row, err := table.GetRowContext(ctx, key, true)
+		if err == nil && q.Where.eval([]byte(row.Key), []byte(row.Value)) {
+			resRow = append(resRow, row)
+		}else if err != nil && err != io.EOF {
+			return resRow, err
+		}
+	}else{
+		limit := q.Limit
+		if q.OrderBy != "" {
+			// every row is needed to sort before the limit can be applied
+			limit = 0
+		}
+
+		resRow, err = table.FilterContext(ctx, q.Where.eval, limit, true)
+		if err != nil && err != io.EOF {
+			return resRow, err
+		}
+	}
+
+	if q.OrderBy != "" {
+		sort.SliceStable(resRow, func(i, j int) bool {
+			var a, b string
+			if q.OrderBy == "key" {
+				a, b = resRow[i].Key, resRow[j].Key
+			}else{
+				a, b = resRow[i].Value, resRow[j].Value
+			}
+
+			if q.Desc {
+				return orderQueryValues([]byte(b), []byte(a)) < 0
+			}
+			return orderQueryValues([]byte(a), []byte(b)) < 0
+		})
+	}
+
+	if q.Limit > 0 && len(resRow) > q.Limit {
+		resRow = resRow[:q.Limit]
+	}
+
+	if len(resRow) == 0 {
+		return resRow, io.EOF
+	}
+
+	return resRow, nil
+}
+
+// eval reports whether a row with this key and value is accepted by the expression
+func (expr *QueryExpr) eval(key []byte, value []byte) bool {
+	if expr == nil {
+		return true
+	}
+
+	switch expr.Op {
+	case "AND":
+		return expr.Left.eval(key, value) && expr.Right.eval(key, value)
+	case "OR":
+		return expr.Left.eval(key, value) || expr.Right.eval(key, value)
+	case "NOT":
+		return !expr.Left.eval(key, value)
+	}
+
+	field := key
+	if expr.Field == "value" {
+		field = value
+	}
+
+	switch expr.Op {
+	case "=":
+		return bytes.Equal(field, []byte(expr.Value))
+	case "!=":
+		return !bytes.Equal(field, []byte(expr.Value))
+	case "~":
+		return expr.match.Match(field)
+	case "!~":
+		return !expr.match.Match(field)
+	case ">":
+		return compareQueryValues(field, []byte(expr.Value)) > 0
+	case ">=":
+		return compareQueryValues(field, []byte(expr.Value)) >= 0
+	case "<":
+		return compareQueryValues(field, []byte(expr.Value)) < 0
+	case "<=":
+		return compareQueryValues(field, []byte(expr.Value)) <= 0
+	}
+
+	return false
+}
+
+// exactKey returns the key a row must have to be accepted by the expression, if there is one
+func (expr *QueryExpr) exactKey() (string, bool) {
+	if expr == nil {
+		return "", false
+	}
+
+	switch expr.Op {
+	case "=":
+		return expr.Value, expr.Field == "key"
+	case "AND":
+		if key, ok := expr.Left.exactKey(); ok {
+			return key, true
+		}
+		return expr.Right.exactKey()
+	}
+
+	return "", false
+}
+
+// compareQueryValues compares two values as numbers if both are numbers, and as strings otherwise
+func compareQueryValues(a []byte, b []byte) int {
+	if x, err := strconv.ParseFloat(string(a), 64); err == nil {
+		if y, err := strconv.ParseFloat(string(b), 64); err == nil {
+			if x < y {
+				return -1
+			}else if x > y {
+				return 1
+			}
+			return 0
+		}
+	}
+
+	return bytes.Compare(a, b)
+}
+
+// orderQueryValues compares two values for ORDER BY
+//
+// numbers are sorted before strings, so a column with both still has one consistent order
+func orderQueryValues(a []byte, b []byte) int {
+	x, errA := strconv.ParseFloat(string(a), 64)
+	y, errB := strconv.ParseFloat(string(b), 64)
+
+	// NaN cannot be compared with other numbers, so it is sorted as a string
+	numA := errA == nil && !math.IsNaN(x)
+	numB := errB == nil && !math.IsNaN(y)
+
+	if numA && numB {
+		if x < y {
+			return -1
+		}else if x > y {
+			return 1
+		}
+		return 0
+	}else if numA {
+		return -1
+	}else if numB {
+		return 1
+	}
+
+	return bytes.Compare(a, b)
+}
+
+
+type queryParser struct {
+	tokens []queryToken
+	pos int
+}
+
+func (p *queryParser) peek() queryToken {
+	return p.tokens[p.pos]
+}
+
+func (p *queryParser) next() queryToken {
+	tok := p.tokens[p.pos]
+	if tok.kind != tokEOF {
+		p.pos++
+	}
+	return tok
+}
+
+// keyword consumes the next token if it is the keyword (case insensitive)
+func (p *queryParser) keyword(word string) bool {
+	if tok := p.peek(); tok.kind == tokIdent && strings.EqualFold(tok.val, word) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *queryParser) errorf(msg string) error {
+	return p.errorAt(p.peek(), msg)
+}
+
+func (p *queryParser) errorAt(tok queryToken, msg string) error {
+	return errors.New("query: "+msg+" at position "+strconv.Itoa(tok.pos))
+}
+
+func (p *queryParser) parseOr() (*QueryExpr, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.keyword("OR") {
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &QueryExpr{Op: "OR", Left: left, Right: right}
+	}
+
+	return left, nil
+}
+
+func (p *queryParser) parseAnd() (*QueryExpr, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.keyword("AND") {
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		left = &QueryExpr{Op: "AND", Left: left, Right: right}
+	}
+
+	return left, nil
+}
+
+func (p *queryParser) parseNot() (*QueryExpr, error) {
+	if p.keyword("NOT") {
+		expr, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return &QueryExpr{Op: "NOT", Left: expr}, nil
+	}
+
+	return p.parseCompare()
+}
+
+func (p *queryParser) parseCompare() (*QueryExpr, error) {
+	tok := p.next()
+
+	if tok.kind == tokOpen {
+		expr, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if tok := p.next(); tok.kind != tokClose {
+			return nil, p.errorAt(tok, "expected ')'")
+		}
+		return expr, nil
+	}
+
+	field := strings.ToLower(tok.val)
+	if tok.kind != tokIdent || (field != "key" && field != "value") {
+		return nil, p.errorAt(tok, "expected key or value")
+	}
+
+	op := p.next()
+	if op.kind != tokOp {
+		return nil, p.errorAt(op, "expected an operator")
+	}
+
+	val := p.next()
+	if val.kind != tokString && val.kind != tokNumber {
+		return nil, p.errorAt(val, "expected a string or number")
+	}
+
+	expr := &QueryExpr{Op: op.val, Field: field, Value: val.val}
+
+	if op.val == "~" || op.val == "!~" {
+		expr.match = Regex(val.val)
+		if expr.match.err != nil {
+			return nil, p.errorAt(val, "invalid regex: "+expr.match.err.Error())
+		}
+	}
+
+	return expr, nil
+}
+
+
+// lexQuery splits a query string into tokens
+func lexQuery(query string) ([]queryToken, error) {
+	tokens := []queryToken{}
+
+	for i := 0; i < len(query); {
+		c := query[i]
+
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+
+		case c == '(':
+			tokens = append(tokens, queryToken{kind: tokOpen, val: "(", pos: i})
+			i++
+
+		case c == ')':
+			tokens = append(tokens, queryToken{kind: tokClose, val: ")", pos: i})
+			i++
+
+		case c == '"' || c == '\'':
+			// only the quote and backslash can be escaped, so regex escapes like \d are kept as they are
+			start := i
+			var val strings.Builder
+			i++
+			for i < len(query) && query[i] != c {
+				if query[i] == '\\' && i+1 < len(query) && (query[i+1] == c || query[i+1] == '\\') {
+					i++
+				}
+				val.WriteByte(query[i])
+				i++
+			}
+			if i >= len(query) {
+				return nil, errors.New("query: unterminated string at position "+strconv.Itoa(start))
+			}
+			i++
+
+			tokens = append(tokens, queryToken{kind: tokString, val: val.String(), pos: start})
+
+		case c == '=' || c == '~' || c == '!' || c == '<' || c == '>':
+			start := i
+			i++
+			if i < len(query) && ((query[i] == '=' && c != '~') || (c == '!' && query[i] == '~')) {
+				i++
+			}
+
+			op := query[start:i]
+			if op == "==" {
+				op = "="
+			}else if op == "!" {
+				return nil, errors.New("query: unexpected '!' at position "+strconv.Itoa(start))
+			}
+			tokens = append(tokens, queryToken{kind: tokOp, val: op, pos: start})
+
+		case c == '-' || c == '.' || (c >= '0' && c <= '9'):
+			start := i
+			i++
+			for i < len(query) && (query[i] == '.' || (query[i] >= '0' && query[i] <= '9')) {
+				i++
+			}
+			tokens = append(tokens, queryToken{kind: tokNumber, val: query[start:i], pos: start})
+
+		case c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z'):
+			start := i
+			for i < len(query) && (query[i] == '_' || query[i] == '-' || query[i] == '.' || (query[i] >= 'a' && query[i] <= 'z') || (query[i] >= 'A' && query[i] <= 'Z') || (query[i] >= '0' && query[i] <= '9')) {
+				i++
+			}
+			tokens = append(tokens, queryToken{kind: tokIdent, val: query[start:i], pos: start})
+
+		default:
+			return nil, errors.New("query: unexpected '"+string(c)+"' at position "+strconv.Itoa(i))
+		}
+	}
+
+	tokens = append(tokens, queryToken{kind: tokEOF, pos: len(query)})
+	return tokens, nil
+}
@@ -0,0 +1,447 @@
+package db
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"unicode/utf8"
+)
+
+// Schema is a set of rules that every row in a table must follow
+//
+// empty rules are ignored, and lengths are counted in characters
+type Schema struct {
+	// KeyPattern is an RE2 regex that every key must match
+	KeyPattern string `json:"keyPattern,omitempty"`
+	MaxKeyLength int `json:"maxKeyLength,omitempty"`
+
+	// ValuePattern is an RE2 regex that every value must match
+	ValuePattern string `json:"valuePattern,omitempty"`
+	MaxValueLength int `json:"maxValueLength,omitempty"`
+
+	// JSON requires every value to be valid json, which matches a subset of JSON Schema
+	JSON *JSONSchema `json:"json,omitempty"`
+
+	keyRe *Matcher
+	valueRe *Matcher
+}
+
+// JSONSchema is the subset of JSON Schema supported by a table Schema
+//
+// a JSON Schema document using these keywords can be decoded into this struct with encoding/json
+type JSONSchema struct {
+	// Type is one of "object", "array", "string", "number", "integer", "boolean", or "null"
+	Type string `json:"type,omitempty"`
+
+	Enum []any `json:"enum,omitempty"`
+
+	// object
+	Properties map[string]*JSONSchema `json:"properties,omitempty"`
+	Required []string `json:"required,omitempty"`
+	AdditionalProperties *bool `json:"additionalProperties,omitempty"`
+
+	// array
+	Items *JSONSchema `json:"items,omitempty"`
+	MinItems *int `json:"minItems,omitempty"`
+	MaxItems *int `json:"maxItems,omitempty"`
+
+	// string
+	MinLength *int `json:"minLength,omitempty"`
+	MaxLength *int `json:"maxLength,omitempty"`
+	Pattern string `json:"pattern,omitempty"`
+
+	// number
+	Minimum *float64 `json:"minimum,omitempty"`
+	Maximum *float64 `json:"maximum,omitempty"`
+
+	patternRe *Matcher
+}
+
+// SchemaError is returned when a row does not follow the schema of its table
+type SchemaError struct {
+	// Rule is the name of the rule that failed (i.e. "maxValueLength", or "required" for a json schema)
+	Rule string
+
+	// Path is the location of the json value that failed (i.e. "$.tags[2]"), or "key" and "value" for the other rules
+	Path string
+
+	Message string
+}
+
+func (err *SchemaError) Error() string {
+	return "schema: "+err.Rule+" failed at "+err.Path+": "+err.Message
+}
+
+// SetSchema sets the rules that new rows and values of the table must follow
+//
+// the schema is stored with the table, and is only checked on writes,
+// so existing rows that do not follow it will keep their values
+//
+// @schema nil removes the schema
+func (table *Table) SetSchema(schema *Schema, noLock ...bool) error {
+	if schema != nil {
+		schema = schema.clone()
+		if err := schema.compile(); err != nil {
+			return err
+		}
+	}
+
+	if len(noLock) == 0 || noLock[0] == false {
+		table.db.mu.Lock()
+		defer table.db.mu.Unlock()
+	}
+
+	if err := table.checkDeleted(); err != nil {
+		return err
+	}
+
+	oldSchema := table.meta.Schema
+	table.meta.Schema = schema
+
+	table.db.file.Seek(table.line * int64(table.db.bitSize), io.SeekStart)
+	if _, err := setDataObj(table.db, '$', table.key, table.encodeVal()); err != nil {
+		table.meta.Schema = oldSchema
+		return err
+	}
+
+	return table.db.syncWrite(nil)
+}
+
+// Schema returns a copy of the schema of the table, or nil if it does not have one
+func (table *Table) Schema() *Schema {
+	if table.meta.Schema == nil {
+		return nil
+	}
+	return table.meta.Schema.clone()
+}
+
+// validateKey checks a key against the schema of the table
+func (table *Table) validateKey(key []byte) error {
+	schema := table.meta.Schema
+	if schema == nil {
+		return nil
+	}
+
+	if err := schema.compile(); err != nil {
+		return err
+	}
+
+	if schema.MaxKeyLength > 0 && utf8.RuneCount(key) > schema.MaxKeyLength {
+		return &SchemaError{Rule: "maxKeyLength", Path: "key", Message: "longer than "+strconv.Itoa(schema.MaxKeyLength)+" characters"}
+	}
+	if schema.keyRe != nil && !schema.keyRe.Match(key) {
+		return &SchemaError{Rule: "keyPattern", Path: "key", Message: "does not match "+strconv.Quote(schema.KeyPattern)}
+	}
+
+	return nil
+}
+
+// validateValue checks a value against the schema of the table
+func (table *Table) validateValue(value []byte) error {
+	schema := table.meta.Schema
+	if schema == nil {
+		return nil
+	}
+
+	if err := schema.compile(); err != nil {
+		return err
+	}
+
+	if schema.MaxValueLength > 0 && utf8.RuneCount(value) > schema.MaxValueLength {
+		return &SchemaError{Rule: "maxValueLength", Path: "value", Message: "longer than "+strconv.Itoa(schema.MaxValueLength)+" characters"}
+	}
+	if schema.valueRe != nil && !schema.valueRe.Match(value) {
+		return &SchemaError{Rule: "valuePattern", Path: "value", Message: "does not match "+strconv.Quote(schema.ValuePattern)}
+	}
+
+	if schema.JSON != nil {
+		dec := json.NewDecoder(bytes.NewReader(value))
+		dec.UseNumber()
+
+		var val any
+		if err := dec.Decode(&val); err != nil {
+			return &SchemaError{Rule: "json", Path: "value", Message: "not valid json: "+err.Error()}
+		}else if dec.More() {
+			return &SchemaError{Rule: "json", Path: "value", Message: "not valid json: unexpected data after the top level value"}
+		}
+
+		return schema.JSON.validate(val, "$")
+	}
+
+	return nil
+}
+
+// compile compiles the regex patterns of the schema, if they have not been compiled yet
+func (schema *Schema) compile() error {
+	if schema.KeyPattern != "" && schema.keyRe == nil {
+		re := Regex(schema.KeyPattern)
+		if re.err != nil {
+			return errors.New("schema: invalid keyPattern: "+re.err.Error())
+		}
+		schema.keyRe = &re
+	}
+
+	if schema.ValuePattern != "" && schema.valueRe == nil {
+		re := Regex(schema.ValuePattern)
+		if re.err != nil {
+			return errors.New("schema: invalid valuePattern: "+re.err.Error())
+		}
+		schema.valueRe = &re
+	}
+
+	if schema.JSON != nil {
+		return schema.JSON.compile("$")
+	}
+
+	return nil
+}
+
+func (schema *JSONSchema) compile(path string) error {
+	switch schema.Type {
+	case "", "object", "array", "string", "number", "integer", "boolean", "null":
+	default:
+		return errors.New("schema: unknown json type "+strconv.Quote(schema.Type)+" at "+path)
+	}
+
+	if schema.Pattern != "" && schema.patternRe == nil {
+		re := Regex(schema.Pattern)
+		if re.err != nil {
+			return errors.New("schema: invalid pattern at "+path+": "+re.err.Error())
+		}
+		schema.patternRe = &re
+	}
+
+	// the schema is stored as json with the table, so every enum value must be encodable
+	for _, e := range schema.Enum {
+		if _, err := json.Marshal(e); err != nil {
+			return errors.New("schema: invalid enum value at "+path+": "+err.Error())
+		}
+	}
+
+	for name, prop := range schema.Properties {
+		if prop != nil {
+			if err := prop.compile(path+"."+name); err != nil {
+				return err
+			}
+		}
+	}
+
+	if schema.Items != nil {
+		return schema.Items.compile(path+"[]")
+	}
+
+	return nil
+}
+
+// validate checks a decoded json value against the schema
+func (schema *JSONSchema) validate(val any, path string) error {
+	if schema.Type != "" && jsonType(val, schema.Type == "integer") != schema.Type {
+		if !(schema.Type == "number" && jsonType(val, false) == "number") {
+			return &SchemaError{Rule: "type", Path: path, Message: "expected "+schema.Type+", got "+jsonType(val, false)}
+		}
+	}
+
+	if len(schema.Enum) != 0 {
+		found := false
+		for _, e := range schema.Enum {
+			if jsonEqual(val, e) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return &SchemaError{Rule: "enum", Path: path, Message: "not one of the allowed values"}
+		}
+	}
+
+	switch v := val.(type) {
+	case map[string]any:
+		for _, name := range schema.Required {
+			if _, ok := v[name]; !ok {
+				return &SchemaError{Rule: "required", Path: path, Message: "missing property "+strconv.Quote(name)}
+			}
+		}
+
+		names := make([]string, 0, len(v))
+		for name := range v {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			if prop, ok := schema.Properties[name]; ok {
+				if prop != nil {
+					if err := prop.validate(v[name], path+"."+name); err != nil {
+						return err
+					}
+				}
+			}else if schema.AdditionalProperties != nil && !*schema.AdditionalProperties {
+				return &SchemaError{Rule: "additionalProperties", Path: path, Message: "unexpected property "+strconv.Quote(name)}
+			}
+		}
+
+	case []any:
+		if schema.MinItems != nil && len(v) < *schema.MinItems {
+			return &SchemaError{Rule: "minItems", Path: path, Message: "fewer than "+strconv.Itoa(*schema.MinItems)+" items"}
+		}
+		if schema.MaxItems != nil && len(v) > *schema.MaxItems {
+			return &SchemaError{Rule: "maxItems", Path: path, Message: "more than "+strconv.Itoa(*schema.MaxItems)+" items"}
+		}
+
+		if schema.Items != nil {
+			for i, item := range v {
+				if err := schema.Items.validate(item, path+"["+strconv.Itoa(i)+"]"); err != nil {
+					return err
+				}
+			}
+		}
+
+	case string:
+		l := utf8.RuneCountInString(v)
+		if schema.MinLength != nil && l < *schema.MinLength {
+			return &SchemaError{Rule: "minLength", Path: path, Message: "shorter than "+strconv.Itoa(*schema.MinLength)+" characters"}
+		}
+		if schema.MaxLength != nil && l > *schema.MaxLength {
+			return &SchemaError{Rule: "maxLength", Path: path, Message: "longer than "+strconv.Itoa(*schema.MaxLength)+" characters"}
+		}
+		if schema.patternRe != nil && !schema.patternRe.Match([]byte(v)) {
+			return &SchemaError{Rule: "pattern", Path: path, Message: "does not match "+strconv.Quote(schema.Pattern)}
+		}
+
+	case json.Number:
+		n, err := v.Float64()
+		if err != nil {
+			return &SchemaError{Rule: "type", Path: path, Message: "number out of range"}
+		}
+		if schema.Minimum != nil && n < *schema.Minimum {
+			return &SchemaError{Rule: "minimum", Path: path, Message: "less than "+strconv.FormatFloat(*schema.Minimum, 'g', -1, 64)}
+		}
+		if schema.Maximum != nil && n > *schema.Maximum {
+			return &SchemaError{Rule: "maximum", Path: path, Message: "greater than "+strconv.FormatFloat(*schema.Maximum, 'g', -1, 64)}
+		}
+	}
+
+	return nil
+}
+
+// jsonType returns the JSON Schema type of a decoded json value
+//
+// @integer reports whole numbers as "integer" instead of "number"
+func jsonType(val any, integer bool) string {
+	switch v := val.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case []any:
+		return "array"
+	case map[string]any:
+		return "object"
+	case json.Number:
+		if integer {
+			if n, err := v.Float64(); err == nil && n == math.Trunc(n) {
+				return "integer"
+			}
+		}
+		return "number"
+	}
+	return "unknown"
+}
+
+// jsonEqual compares a decoded json value with an enum value
+func jsonEqual(val any, e any) bool {
+	a, err1 := json.Marshal(val)
+	b, err2 := json.Marshal(e)
+	if err1 != nil || err2 != nil {
+		return false
+	}
+
+	// numbers are compared by value, so 1 and 1.0 are equal
+	if n, ok := val.(json.Number); ok {
+		nf, err1 := n.Float64()
+		ef, err2 := strconv.ParseFloat(string(b), 64)
+		return err1 == nil && err2 == nil && nf == ef
+	}
+
+	return bytes.Equal(a, b)
+}
+
+// clone returns a copy of the schema, so changes made by the caller do not affect the table
+func (schema *Schema) clone() *Schema {
+	res := *schema
+	if schema.JSON != nil {
+		res.JSON = schema.JSON.clone()
+	}
+	return &res
+}
+
+func (schema *JSONSchema) clone() *JSONSchema {
+	res := *schema
+
+	if schema.Enum != nil {
+		res.Enum = make([]any, len(schema.Enum))
+		for i, e := range schema.Enum {
+			res.Enum[i] = cloneJSONValue(e)
+		}
+	}
+
+	if schema.Properties != nil {
+		res.Properties = make(map[string]*JSONSchema, len(schema.Properties))
+		for name, prop := range schema.Properties {
+			if prop != nil {
+				prop = prop.clone()
+			}
+			res.Properties[name] = prop
+		}
+	}
+
+	if schema.Required != nil {
+		res.Required = append([]string{}, schema.Required...)
+	}
+	if schema.Items != nil {
+		res.Items = schema.Items.clone()
+	}
+
+	res.AdditionalProperties = clonePtr(schema.AdditionalProperties)
+	res.MinItems = clonePtr(schema.MinItems)
+	res.MaxItems = clonePtr(schema.MaxItems)
+	res.MinLength = clonePtr(schema.MinLength)
+	res.MaxLength = clonePtr(schema.MaxLength)
+	res.Minimum = clonePtr(schema.Minimum)
+	res.Maximum = clonePtr(schema.Maximum)
+
+	return &res
+}
+
+// cloneJSONValue copies the maps and slices of a decoded json value
+func cloneJSONValue(val any) any {
+	switch v := val.(type) {
+	case map[string]any:
+		res := make(map[string]any, len(v))
+		for key, item := range v {
+			res[key] = cloneJSONValue(item)
+		}
+		return res
+	case []any:
+		res := make([]any, len(v))
+		for i, item := range v {
+			res[i] = cloneJSONValue(item)
+		}
+		return res
+	}
+	return val
+}
+
+func clonePtr[T any](ptr *T) *T {
+	if ptr == nil {
+		return nil
+	}
+	val := *ptr
+	return &val
+}
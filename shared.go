@@ -0,0 +1,255 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// errSharedWrite is returned when an operation that only took a shared lock tries to write to a ModeShared database
+var errSharedWrite = errors.New("cannot write to a shared database without an exclusive lock")
+
+// dbMutex is the lock of a database
+//
+// with ModeShared, it also takes an advisory lock on the file for each operation,
+// and refreshes the database when the file was changed by another process
+//
+// within one process, readers and writers always take turns, since they share the position of the file
+//
+// the lock is a channel with room for one value, so waiting for it can be canceled without leaving a goroutine behind
+type dbMutex struct {
+	sem chan struct{}
+	once sync.Once
+	db *Database
+
+	// file is only set for ModeShared
+	file *os.File
+
+	// exclusive is true while the file lock is an exclusive lock
+	exclusive bool
+
+	// wrote is true once the current operation has written to the file
+	wrote bool
+}
+
+// Lock waits for the database lock, with an exclusive file lock for ModeShared
+func (m *dbMutex) Lock() {
+	m.lock(true)
+}
+
+// RLock waits for the database lock, with a shared file lock for ModeShared
+//
+// the operation must not write to the database
+func (m *dbMutex) RLock() {
+	m.lock(false)
+}
+
+// Unlock releases the database lock
+//
+// if the operation wrote to the file, this also updates the change counter for ModeShared
+//
+// the change counter only tells running processes to refresh, so it does not need to be synced for SyncEveryWrite
+func (m *dbMutex) Unlock() {
+	if m.wrote {
+		if m.file != nil {
+			m.db.writeChangeCount(m.db.changeCount + 1)
+		}
+		m.wrote = false
+	}
+
+	if m.file != nil {
+		unlockFile(m.file)
+		m.exclusive = false
+	}
+	<-m.sem
+}
+
+// RUnlock releases the database lock taken by RLock
+func (m *dbMutex) RUnlock() {
+	m.Unlock()
+}
+
+// init creates the channel of the lock, so the zero value of a dbMutex can be used
+func (m *dbMutex) init() {
+	m.once.Do(func(){
+		m.sem = make(chan struct{}, 1)
+	})
+}
+
+func (m *dbMutex) lock(exclusive bool) {
+	m.init()
+	m.sem <- struct{}{}
+	m.wrote = false
+
+	if m.file != nil {
+		// a lock is only refused while waiting if the file is closed,
+		// so the operation fails on its own when it reads the file
+		lockFile(m.file, exclusive, true)
+		m.locked(exclusive)
+	}
+}
+
+// lockContext is the same as lock, but gives up with ctx.Err() once the context is done
+//
+// advisory file locks cannot be waited for with a context, so the file lock is retried until it is free
+func (m *dbMutex) lockContext(ctx context.Context, exclusive bool) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	m.init()
+	select {
+	case m.sem <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	m.wrote = false
+
+	if m.file == nil {
+		return nil
+	}
+
+	wait := time.Millisecond
+	for {
+		if err := lockFile(m.file, exclusive, false); err != ErrLocked {
+			break
+		}
+
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			<-m.sem
+			return ctx.Err()
+		}
+
+		if wait < 50 * time.Millisecond {
+			wait *= 2
+		}
+	}
+
+	m.locked(exclusive)
+	return nil
+}
+
+// locked refreshes the database, if another process changed the file since it was last locked
+func (m *dbMutex) locked(exclusive bool) {
+	m.exclusive = exclusive
+
+	if count := m.db.readChangeCount(); count != m.db.changeCount {
+		m.db.changeCount = count
+		m.db.refresh()
+	}
+}
+
+// checkShared returns an error if a ModeShared database is written to without an exclusive lock,
+// and remembers that the current operation has changed the file
+func (db *Database) checkShared() error {
+	if db.mu.file != nil && !db.mu.exclusive {
+		return errSharedWrite
+	}
+
+	db.mu.wrote = true
+	return nil
+}
+
+// syncWrite syncs the file for SyncEveryWrite, if the current operation wrote to it
+//
+// write methods call this before they return, while the lock is still held, so a failed sync is returned to the caller
+//
+// @err is the result of the write, which is returned instead of a sync error
+func (db *Database) syncWrite(err error) error {
+	if db.syncPolicy == SyncEveryWrite && db.mu.wrote {
+		if syncErr := db.file.Sync(); syncErr != nil && err == nil {
+			return syncErr
+		}
+	}
+	return err
+}
+
+// changeCountRange returns the byte range in the file header that holds the change counter
+//
+// the header starts with "#bit=", the bit size, and the layout flags, and the counter uses the padding after them
+func (db *Database) changeCountRange() (int64, int64) {
+	end := int64(db.bitSize)
+	if db.textLayout {
+		end--
+	}
+
+	// 13 base36 digits can hold any uint64
+	if end > 23 {
+		end = 23
+	}
+	return 10, end
+}
+
+// readChangeCount reads the change counter from the file header
+//
+// older files, and files that were only used by one process, have a counter of 0
+func (db *Database) readChangeCount() uint64 {
+	start, end := db.changeCountRange()
+
+	buf := make([]byte, end - start)
+	if _, err := db.file.ReadAt(buf, start); err != nil {
+		return 0
+	}
+
+	if count, err := strconv.ParseUint(string(bytes.TrimRight(buf, "-")), 36, 64); err == nil {
+		return count
+	}
+	return 0
+}
+
+// writeChangeCount writes the change counter to the file header
+//
+// the counter wraps around if it does not fit, since readers only check if it has changed
+func (db *Database) writeChangeCount(count uint64) {
+	start, end := db.changeCountRange()
+	size := int(end - start)
+
+	s := strconv.FormatUint(count, 36)
+	if len(s) > size {
+		s = s[len(s)-size:]
+		count, _ = strconv.ParseUint(s, 36, 64)
+	}
+
+	db.file.Seek(start, io.SeekStart)
+	db.file.Write([]byte(s+strings.Repeat("-", size - len(s))))
+	db.changeCount = count
+}
+
+// refresh drops the state that was read from the file, after another process changed it
+//
+// the cached table handles are reloaded from the file, so they see the current row list,
+// and a handle to a table that no longer exists returns ErrTableDeleted
+//
+// the other process may have freed and reused any block, so every Row and Data handle becomes stale, like after Optimize
+func (db *Database) refresh() {
+	db.tableCount = -1
+	db.dataCount = -1
+
+	db.genCount++
+	db.minGen = db.genCount
+	db.gens = map[int64]uint64{}
+
+	db.cache.ForEach(func(lineKey string, table *Table) bool {
+		if table.line == -1 {
+			return true
+		}
+
+		if obj, err := readObjAt(db, '$', table.line); err == nil && bytes.Equal(obj.key, table.key) {
+			// the table was just read again, so its handle stays valid
+			table.val, table.meta = decodeTableVal(obj.val)
+			table.gen = db.minGen
+		}else{
+			table.line = -1
+			db.cache.Del(lineKey)
+		}
+		return true
+	})
+}
@@ -0,0 +1,249 @@
+package db
+
+import (
+	"errors"
+	"io"
+	"sync"
+
+	"github.com/alphadose/haxmap"
+)
+
+// ErrReadOnly is returned when writing to a read only database, such as a Snapshot
+var ErrReadOnly = errors.New("database is read only")
+
+// dbFile is the file a database reads and writes its blocks to
+type dbFile interface {
+	io.ReadWriteSeeker
+	io.ReaderAt
+	Sync() error
+	Close() error
+}
+
+// cowFile wraps the file of a database, and copies each block to the open snapshots before it is changed
+type cowFile struct {
+	dbFile
+
+	mu sync.Mutex
+	snapshots map[*snapshotFile]bool
+}
+
+// snapshotFile is a read only view of a cowFile, at the time the snapshot was taken
+type snapshotFile struct {
+	cow *cowFile
+	size int64
+	bitSize int64
+	pos int64
+
+	// blocks holds the original content of every block that changed after the snapshot was taken
+	blocks map[int64][]byte
+	closed bool
+}
+
+// Snapshot returns a read only view of the database, as it is right now
+//
+// the snapshot has its own lock, so long scans of the snapshot will not stop writes to the database,
+// and will not see any changes made after the snapshot was taken
+//
+// blocks are copied to the snapshot before they are changed, so a snapshot should be closed once it is no longer needed
+//
+// writing to the snapshot returns ErrReadOnly
+func (db *Database) Snapshot(noLock ...bool) (*Database, error) {
+	if len(noLock) == 0 || noLock[0] == false {
+		db.mu.RLock()
+		defer db.mu.RUnlock()
+	}
+
+	cow, ok := db.file.(*cowFile)
+	if !ok {
+		return &Database{}, errors.New("database does not support snapshots")
+	}
+
+	pos, _ := cow.Seek(0, io.SeekCurrent)
+	size, err := cow.Seek(0, io.SeekEnd)
+	cow.Seek(pos, io.SeekStart)
+	if err != nil {
+		return &Database{}, err
+	}
+
+	snap := &snapshotFile{
+		cow: cow,
+		size: size,
+		bitSize: int64(db.bitSize),
+		blocks: map[int64][]byte{},
+	}
+
+	cow.mu.Lock()
+	if cow.snapshots == nil {
+		cow.snapshots = map[*snapshotFile]bool{}
+	}
+	cow.snapshots[snap] = true
+	cow.mu.Unlock()
+
+	return &Database{
+		file: snap,
+		path: db.path,
+		bitSize: db.bitSize,
+		prefixList: db.prefixList,
+		cache: haxmap.New[string, *Table](),
+		encKey: db.encKey,
+		tableCount: -1,
+		dataCount: -1,
+		gens: map[int64]uint64{},
+		readOnly: true,
+		compress: db.compress,
+		textLayout: db.textLayout,
+	}, nil
+}
+
+// checkWritable returns ErrReadOnly if the database cannot be changed
+func (db *Database) checkWritable() error {
+	if db.readOnly {
+		return ErrReadOnly
+	}
+	return db.checkShared()
+}
+
+// hasSnapshots reports whether any snapshots of the file are still open
+func (cow *cowFile) hasSnapshots() bool {
+	cow.mu.Lock()
+	defer cow.mu.Unlock()
+
+	return len(cow.snapshots) != 0
+}
+
+// preserve copies the blocks in a byte range to every snapshot that does not have them yet
+func (cow *cowFile) preserve(off int64, size int) {
+	cow.mu.Lock()
+	defer cow.mu.Unlock()
+
+	for snap := range cow.snapshots {
+		if off >= snap.size {
+			continue
+		}
+
+		end := off + int64(size)
+		if end > snap.size {
+			end = snap.size
+		}
+
+		for block := off / snap.bitSize; block * snap.bitSize < end; block++ {
+			if _, ok := snap.blocks[block]; ok {
+				continue
+			}
+
+			start := block * snap.bitSize
+			buf := make([]byte, snap.bitSize)
+			if start + snap.bitSize > snap.size {
+				buf = buf[:snap.size - start]
+			}
+
+			n, _ := cow.dbFile.ReadAt(buf, start)
+			snap.blocks[block] = buf[:n]
+		}
+	}
+}
+
+func (cow *cowFile) Write(p []byte) (int, error) {
+	if cow.hasSnapshots() {
+		pos, err := cow.dbFile.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return 0, err
+		}
+		cow.preserve(pos, len(p))
+	}
+
+	return cow.dbFile.Write(p)
+}
+
+func (snap *snapshotFile) ReadAt(p []byte, off int64) (int, error) {
+	snap.cow.mu.Lock()
+	defer snap.cow.mu.Unlock()
+
+	if snap.closed {
+		return 0, errors.New("snapshot is closed")
+	}
+
+	n := 0
+	for n < len(p) {
+		pos := off + int64(n)
+		if pos >= snap.size {
+			return n, io.EOF
+		}
+
+		block := pos / snap.bitSize
+		blockOff := pos - block * snap.bitSize
+
+		want := int64(len(p) - n)
+		if rem := snap.bitSize - blockOff; want > rem {
+			want = rem
+		}
+		if rem := snap.size - pos; want > rem {
+			want = rem
+		}
+
+		if buf, ok := snap.blocks[block]; ok {
+			if blockOff >= int64(len(buf)) {
+				return n, io.EOF
+			}
+			c := copy(p[n:n+int(want)], buf[blockOff:])
+			n += c
+			if int64(c) < want {
+				return n, io.EOF
+			}
+			continue
+		}
+
+		c, err := snap.cow.dbFile.ReadAt(p[n:n+int(want)], pos)
+		n += c
+		if err != nil {
+			return n, err
+		}
+	}
+
+	return n, nil
+}
+
+func (snap *snapshotFile) Read(p []byte) (int, error) {
+	n, err := snap.ReadAt(p, snap.pos)
+	snap.pos += int64(n)
+	return n, err
+}
+
+func (snap *snapshotFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += snap.pos
+	case io.SeekEnd:
+		offset += snap.size
+	default:
+		return snap.pos, errors.New("invalid whence")
+	}
+
+	if offset < 0 {
+		return snap.pos, errors.New("negative position")
+	}
+
+	snap.pos = offset
+	return offset, nil
+}
+
+func (snap *snapshotFile) Write(p []byte) (int, error) {
+	return 0, ErrReadOnly
+}
+
+func (snap *snapshotFile) Sync() error {
+	return nil
+}
+
+// Close releases the blocks held by the snapshot, without closing the database file
+func (snap *snapshotFile) Close() error {
+	snap.cow.mu.Lock()
+	defer snap.cow.mu.Unlock()
+
+	delete(snap.cow.snapshots, snap)
+	snap.blocks = nil
+	snap.closed = true
+
+	return nil
+}
@@ -0,0 +1,180 @@
+package db
+
+import (
+	"errors"
+	"io"
+	"os"
+	"sync"
+)
+
+// Storage is where the blocks of a database are kept
+//
+// the database only reads and writes at offsets, so any backend that implements this interface can be used with WithStorage
+type Storage interface {
+	io.ReaderAt
+	io.WriterAt
+
+	// Size returns the number of bytes in the storage
+	Size() (int64, error)
+
+	// Sync flushes any buffered writes to a durable place
+	Sync() error
+
+	// Truncate changes the size of the storage
+	Truncate(size int64) error
+
+	Close() error
+}
+
+// FileStorage is a Storage that keeps the database in a file
+//
+// Open uses this storage when no other storage is chosen, and the advisory locks of WithMode need a file
+type FileStorage struct {
+	*os.File
+}
+
+// Size returns the size of the file
+func (fs FileStorage) Size() (int64, error) {
+	stat, err := fs.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return stat.Size(), nil
+}
+
+// MemoryStorage is a Storage that keeps the database in memory
+//
+// closing the database does not drop the data, so the same storage can be opened again,
+// until it is no longer referenced
+type MemoryStorage struct {
+	mu sync.RWMutex
+	data []byte
+}
+
+// NewMemoryStorage returns an empty MemoryStorage
+func NewMemoryStorage() *MemoryStorage {
+	return &MemoryStorage{}
+}
+
+// ReadAt reads from the memory at an offset
+func (mem *MemoryStorage) ReadAt(p []byte, off int64) (int, error) {
+	mem.mu.RLock()
+	defer mem.mu.RUnlock()
+
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}else if off >= int64(len(mem.data)) {
+		return 0, io.EOF
+	}
+
+	n := copy(p, mem.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// WriteAt writes to the memory at an offset, and grows the memory if needed
+func (mem *MemoryStorage) WriteAt(p []byte, off int64) (int, error) {
+	mem.mu.Lock()
+	defer mem.mu.Unlock()
+
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+
+	if end := off + int64(len(p)); end > int64(len(mem.data)) {
+		if end > int64(cap(mem.data)) {
+			data := make([]byte, end, end * 2)
+			copy(data, mem.data)
+			mem.data = data
+		}else{
+			mem.data = mem.data[:end]
+		}
+	}
+
+	return copy(mem.data[off:], p), nil
+}
+
+// Size returns the number of bytes in the memory
+func (mem *MemoryStorage) Size() (int64, error) {
+	mem.mu.RLock()
+	defer mem.mu.RUnlock()
+
+	return int64(len(mem.data)), nil
+}
+
+// Sync does nothing, since the memory is never flushed anywhere
+func (mem *MemoryStorage) Sync() error {
+	return nil
+}
+
+// Truncate changes the size of the memory
+func (mem *MemoryStorage) Truncate(size int64) error {
+	mem.mu.Lock()
+	defer mem.mu.Unlock()
+
+	if size < 0 {
+		return errors.New("negative size")
+	}else if size <= int64(len(mem.data)) {
+		// clear the bytes that are cut off, in case the memory grows again
+		for i := size; i < int64(len(mem.data)); i++ {
+			mem.data[i] = 0
+		}
+		mem.data = mem.data[:size]
+		return nil
+	}
+
+	data := make([]byte, size)
+	copy(data, mem.data)
+	mem.data = data
+	return nil
+}
+
+// Close does nothing, so the data is still there if the storage is opened again
+func (mem *MemoryStorage) Close() error {
+	return nil
+}
+
+// storageFile gives a Storage the position, and the Seek, Read, and Write methods, that the database uses to walk through blocks
+type storageFile struct {
+	Storage
+	pos int64
+}
+
+func (sf *storageFile) Read(p []byte) (int, error) {
+	n, err := sf.ReadAt(p, sf.pos)
+	sf.pos += int64(n)
+
+	// like a file, a partial read is not an error, and the next read returns io.EOF
+	if n > 0 && err == io.EOF {
+		err = nil
+	}
+	return n, err
+}
+
+func (sf *storageFile) Write(p []byte) (int, error) {
+	n, err := sf.WriteAt(p, sf.pos)
+	sf.pos += int64(n)
+	return n, err
+}
+
+func (sf *storageFile) Seek(offset int64, whence int) (int64, error) {
+	pos := offset
+	if whence == io.SeekCurrent {
+		pos += sf.pos
+	}else if whence == io.SeekEnd {
+		size, err := sf.Size()
+		if err != nil {
+			return sf.pos, err
+		}
+		pos += size
+	}
+
+	if pos < 0 {
+		return sf.pos, errors.New("negative position")
+	}
+
+	sf.pos = pos
+	return pos, nil
+}
@@ -0,0 +1,164 @@
+package db
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
+)
+
+type structField struct {
+	name string
+	index []int
+	omitEmpty bool
+}
+
+// Put stores a struct as the value of a row, and adds the row if it does not exist yet
+//
+// fields are mapped with `db:"..."` tags
+//  - `db:"name"` stores the field with a different name
+//  - `db:",omitempty"` skips the field when it has its zero value
+//  - `db:"-"` never stores the field
+//
+// fields without a tag are stored by their field name, and unexported fields are skipped
+//
+// the struct is merged into the stored value, so stored fields that are not part of the struct are kept,
+// and a struct from an older version does not remove fields added by a newer one
+func (table *Table) Put(key string, value any, noLock ...bool) error {
+	rv := reflect.ValueOf(value)
+	for rv.Kind() == reflect.Pointer {
+		if rv.IsNil() {
+			return errors.New("Put requires a struct or a non-nil pointer to a struct")
+		}
+		rv = rv.Elem()
+	}
+	if rv.Kind() != reflect.Struct {
+		return errors.New("Put requires a struct or a non-nil pointer to a struct")
+	}
+
+	if len(noLock) == 0 || noLock[0] == false {
+		table.db.mu.Lock()
+		defer table.db.mu.Unlock()
+	}
+
+	row, rowErr := table.GetRow(key, true)
+
+	fieldMap := map[string]any{}
+	if rowErr == nil {
+		var stored map[string]json.RawMessage
+		if json.Unmarshal(row.GetBytes(), &stored) == nil {
+			for name, val := range stored {
+				fieldMap[name] = val
+			}
+		}
+	}
+
+	for _, field := range structFields(rv.Type()) {
+		fv := rv.FieldByIndex(field.index)
+		if field.omitEmpty && fv.IsZero() {
+			delete(fieldMap, field.name)
+			continue
+		}
+		fieldMap[field.name] = fv.Interface()
+	}
+
+	buf, err := json.Marshal(fieldMap)
+	if err != nil {
+		return err
+	}
+
+	if rowErr == nil {
+		return row.SetBytes(buf, true)
+	}
+
+	_, err = table.AddRowBytes(key, buf, true)
+	return err
+}
+
+// Get retrieves a row and stores its value in the struct that value points to
+//
+// fields are mapped with the same `db:"..."` tags used by Put
+//
+// fields that were not stored are left unchanged, and stored fields that no longer exist in the struct are ignored,
+// so a struct can change without breaking the rows that already exist
+func (table *Table) Get(key string, value any, noLock ...bool) error {
+	rv := reflect.ValueOf(value)
+	if rv.Kind() != reflect.Pointer || rv.IsNil() || rv.Elem().Kind() != reflect.Struct {
+		return errors.New("Get requires a non-nil pointer to a struct")
+	}
+	rv = rv.Elem()
+
+	row, err := table.GetRow(key, noLock...)
+	if err != nil {
+		return err
+	}
+
+	fieldMap := map[string]json.RawMessage{}
+	if err := json.Unmarshal(row.GetBytes(), &fieldMap); err != nil {
+		return err
+	}
+
+	for _, field := range structFields(rv.Type()) {
+		if val, ok := fieldMap[field.name]; ok {
+			if err := json.Unmarshal(val, rv.FieldByIndex(field.index).Addr().Interface()); err != nil {
+				return errors.New("field \""+field.name+"\": "+err.Error())
+			}
+		}
+	}
+
+	return nil
+}
+
+// structFields lists the stored fields of a struct type
+//
+// embedded structs without a tag have their fields flattened into the parent
+func structFields(t reflect.Type) []structField {
+	fields := []structField{}
+
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+
+		tag, hasTag := sf.Tag.Lookup("db")
+		if tag == "-" {
+			continue
+		}
+
+		if sf.Anonymous && !hasTag {
+			ft := sf.Type
+			if ft.Kind() == reflect.Pointer {
+				ft = ft.Elem()
+			}
+
+			if ft.Kind() == reflect.Struct && sf.Type.Kind() != reflect.Pointer {
+				for _, field := range structFields(ft) {
+					field.index = append([]int{i}, field.index...)
+					fields = append(fields, field)
+				}
+				continue
+			}
+		}
+
+		if !sf.IsExported() {
+			continue
+		}
+
+		field := structField{
+			name: sf.Name,
+			index: []int{i},
+		}
+
+		opts := strings.Split(tag, ",")
+		if opts[0] != "" {
+			field.name = opts[0]
+		}
+		for _, opt := range opts[1:] {
+			if opt == "omitempty" {
+				field.omitEmpty = true
+			}
+		}
+
+		fields = append(fields, field)
+	}
+
+	return fields
+}
@@ -0,0 +1,235 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/AspieSoft/goutil/v7"
+)
+
+// AddRowTTL adds a new key value pair to the table, which expires after the ttl
+//
+// an expired row is treated as missing by GetRow and the Find methods,
+// and its blocks are freed the next time ReapExpired runs
+func (table *Table) AddRowTTL(key string, value string, ttl time.Duration, noLock ...bool) (*Row, error) {
+	return table.AddRowExpireContext(context.Background(), key, value, time.Now().Add(ttl), noLock...)
+}
+
+// AddRowTTLContext is the same as AddRowTTL, but gives up waiting for the database lock,
+// and stops scanning, once the context is done
+func (table *Table) AddRowTTLContext(ctx context.Context, key string, value string, ttl time.Duration, noLock ...bool) (*Row, error) {
+	return table.AddRowExpireContext(ctx, key, value, time.Now().Add(ttl), noLock...)
+}
+
+// AddRowExpire adds a new key value pair to the table, which expires at a specific time
+//
+// a zero time will never expire
+func (table *Table) AddRowExpire(key string, value string, expire time.Time, noLock ...bool) (*Row, error) {
+	return table.AddRowExpireContext(context.Background(), key, value, expire, noLock...)
+}
+
+// AddRowExpireContext is the same as AddRowExpire, but gives up waiting for the database lock,
+// and stops scanning, once the context is done
+func (table *Table) AddRowExpireContext(ctx context.Context, key string, value string, expire time.Time, noLock ...bool) (*Row, error) {
+	keyB := goutil.Clean.Bytes([]byte(key))
+	keyB = bytes.TrimLeftFunc(keyB, func(r rune) bool {
+		return r == 0
+	})
+
+	valB := goutil.Clean.Bytes([]byte(value))
+	valB = bytes.TrimLeftFunc(valB, func(r rune) bool {
+		return r == 0
+	})
+
+	valB, err := table.storedRowVal(valB, rowHeader{expire: expireMilli(expire)})
+	if err != nil {
+		return &Row{table: table}, err
+	}
+
+	return table.addRow(ctx, keyB, valB, noLock...)
+}
+
+// SetValueTTL changes the value of the row, and makes it expire after the ttl
+//
+// SetValue keeps the expiration the row already had
+func (row *Row) SetValueTTL(value string, ttl time.Duration, noLock ...bool) error {
+	return row.SetValueExpireContext(context.Background(), value, time.Now().Add(ttl), noLock...)
+}
+
+// SetValueTTLContext is the same as SetValueTTL, but gives up waiting for the database lock,
+// and stops scanning, once the context is done
+func (row *Row) SetValueTTLContext(ctx context.Context, value string, ttl time.Duration, noLock ...bool) error {
+	return row.SetValueExpireContext(ctx, value, time.Now().Add(ttl), noLock...)
+}
+
+// SetValueExpire changes the value of the row, and makes it expire at a specific time
+//
+// a zero time will remove the expiration from the row
+func (row *Row) SetValueExpire(value string, expire time.Time, noLock ...bool) error {
+	return row.SetValueExpireContext(context.Background(), value, expire, noLock...)
+}
+
+// SetValueExpireContext is the same as SetValueExpire, but gives up waiting for the database lock,
+// and stops scanning, once the context is done
+func (row *Row) SetValueExpireContext(ctx context.Context, value string, expire time.Time, noLock ...bool) error {
+	valB := goutil.Clean.Bytes([]byte(value))
+	valB = bytes.TrimLeftFunc(valB, func(r rune) bool {
+		return r == 0
+	})
+
+	if len(noLock) == 0 || noLock[0] == false {
+		if err := row.table.db.lockContext(ctx); err != nil {
+			return err
+		}
+		defer row.table.db.mu.Unlock()
+	}
+
+	// the expiry is merged into the stored header, so changes made through another handle are kept
+	exp := expireMilli(expire)
+	return row.setValueExpire(ctx, valB, &exp, true)
+}
+
+// Expire returns the time the row expires
+//
+// @ok is false if the row never expires
+func (row *Row) Expire() (expire time.Time, ok bool) {
+	if row.header.expire == 0 {
+		return time.Time{}, false
+	}
+	return time.UnixMilli(row.header.expire), true
+}
+
+// ReapExpired removes every expired row from the table, and frees their blocks
+//
+// @return the number of rows removed
+func (table *Table) ReapExpired(noLock ...bool) (int, error) {
+	return table.ReapExpiredContext(context.Background(), noLock...)
+}
+
+// ReapExpiredContext is the same as ReapExpired, but gives up waiting for the database lock,
+// and stops scanning, once the context is done
+func (table *Table) ReapExpiredContext(ctx context.Context, noLock ...bool) (int, error) {
+	if len(noLock) == 0 || noLock[0] == false {
+		if err := table.db.lockContext(ctx); err != nil {
+			return 0, err
+		}
+		defer table.db.mu.Unlock()
+	}
+
+	if err := table.db.checkWritable(); err != nil {
+		return 0, err
+	}
+
+	if err := table.checkDeleted(); err != nil {
+		return 0, err
+	}
+
+	expiredLines := map[int64]bool{}
+
+	var err, logErr error
+	rowList := bytes.Split(table.val, []byte{','})
+	for _, rowLine := range rowList {
+		if err = ctx.Err(); err != nil {
+			break
+		}
+
+		if line, e := strconv.ParseInt(string(rowLine), 36, 64); e == nil {
+			table.db.file.Seek(line * int64(table.db.bitSize), io.SeekStart)
+			if rw, e := scanDataObj(ctx, table.db, ':', func(k, v []byte) bool {
+				header, _ := decodeRowVal(v)
+				return header.expired()
+			}, true); e == nil {
+				header, _ := decodeRowVal(rw.val)
+				table.delRow(line, header)
+				expiredLines[line] = true
+
+				_, val := table.rowData(rw.val)
+				if e := table.db.notify(Change{Op: OpDelRow, Table: table.Name, Key: string(rw.key), OldValue: string(val)}); e != nil && logErr == nil {
+					logErr = e
+				}
+			}
+		}
+	}
+
+	// rows that were already freed have to be removed from the row list, even if the context is done
+	if len(expiredLines) != 0 {
+		if e := table.removeRowLines(expiredLines); e != nil && err == nil {
+			err = e
+		}
+	}
+
+	if logErr != nil {
+		return len(expiredLines), table.db.syncWrite(logErr)
+	}
+	return len(expiredLines), table.db.syncWrite(err)
+}
+
+// ReapExpired removes every expired row from every table in the database
+//
+// @return the number of rows removed
+func (db *Database) ReapExpired(noLock ...bool) (int, error) {
+	return db.ReapExpiredContext(context.Background(), noLock...)
+}
+
+// ReapExpiredContext is the same as ReapExpired, but gives up waiting for the database lock,
+// and stops scanning, once the context is done
+func (db *Database) ReapExpiredContext(ctx context.Context, noLock ...bool) (int, error) {
+	if len(noLock) == 0 || noLock[0] == false {
+		if err := db.lockContext(ctx); err != nil {
+			return 0, err
+		}
+		defer db.mu.Unlock()
+	}
+
+	tables, err := db.FindTablesMatchContext(ctx, Any(), true)
+	if err == io.EOF {
+		return 0, nil
+	}else if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for _, table := range tables {
+		n, err := table.ReapExpiredContext(ctx, true)
+		count += n
+		if err != nil {
+			return count, err
+		}
+	}
+
+	return count, nil
+}
+
+// StartReaper runs ReapExpired in the background, once every interval, until the context is done
+func (db *Database) StartReaper(ctx context.Context, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				db.ReapExpiredContext(ctx)
+			}
+		}
+	}()
+}
+
+// expireMilli converts an expiration time to the unix milliseconds stored in a row header
+func expireMilli(expire time.Time) int64 {
+	if expire.IsZero() {
+		return 0
+	}
+
+	exp := expire.UnixMilli()
+	if exp == 0 {
+		// 0 means the row never expires
+		exp = -1
+	}
+	return exp
+}
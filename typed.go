@@ -0,0 +1,226 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"encoding/json"
+	"io"
+
+	"github.com/AspieSoft/goutil/v7"
+)
+
+// AddRowBytes adds a new key value pair to the table
+//
+// unlike AddRow, the value is stored exactly as it is,
+// so it can hold binary data that is not valid UTF-8
+func (table *Table) AddRowBytes(key string, value []byte, noLock ...bool) (*Row, error) {
+	return table.AddRowBytesContext(context.Background(), key, value, noLock...)
+}
+
+// AddRowBytesContext is the same as AddRowBytes, but gives up waiting for the database lock,
+// and stops scanning, once the context is done
+func (table *Table) AddRowBytesContext(ctx context.Context, key string, value []byte, noLock ...bool) (*Row, error) {
+	keyB := goutil.Clean.Bytes([]byte(key))
+	keyB = bytes.TrimLeftFunc(keyB, func(r rune) bool {
+		return r == 0
+	})
+
+	valB, err := table.storedRowVal(goutil.CloneBytes(value), rowHeader{})
+	if err != nil {
+		return &Row{table: table}, err
+	}
+
+	return table.addRow(ctx, keyB, valB, noLock...)
+}
+
+// GetBytes returns the value of the row as a byte slice
+func (row *Row) GetBytes() []byte {
+	return []byte(row.Value)
+}
+
+// SetBytes changes the value of the row
+//
+// unlike SetValue, the value is stored exactly as it is,
+// so it can hold binary data that is not valid UTF-8
+func (row *Row) SetBytes(value []byte, noLock ...bool) error {
+	return row.SetBytesContext(context.Background(), value, noLock...)
+}
+
+// SetBytesContext is the same as SetBytes, but gives up waiting for the database lock,
+// and stops scanning, once the context is done
+func (row *Row) SetBytesContext(ctx context.Context, value []byte, noLock ...bool) error {
+	return row.setValue(ctx, goutil.CloneBytes(value), noLock...)
+}
+
+// AddDataBytes adds a new key value pair to the database
+//
+// unlike AddData, the value is stored exactly as it is,
+// so it can hold binary data that is not valid UTF-8
+func (db *Database) AddDataBytes(key string, value []byte, noLock ...bool) (*Data, error) {
+	return db.AddDataBytesContext(context.Background(), key, value, noLock...)
+}
+
+// AddDataBytesContext is the same as AddDataBytes, but gives up waiting for the database lock,
+// and stops scanning, once the context is done
+func (db *Database) AddDataBytesContext(ctx context.Context, key string, value []byte, noLock ...bool) (*Data, error) {
+	keyB := goutil.Clean.Bytes([]byte(key))
+	keyB = bytes.TrimLeftFunc(keyB, func(r rune) bool {
+		return r == 0
+	})
+
+	return db.addData(ctx, keyB, goutil.CloneBytes(value), noLock...)
+}
+
+// GetBytes returns the value of the key value pair as a byte slice
+func (data *Data) GetBytes() []byte {
+	return []byte(data.Value)
+}
+
+// SetBytes changes the value of the key value pair
+//
+// unlike SetValue, the value is stored exactly as it is,
+// so it can hold binary data that is not valid UTF-8
+func (data *Data) SetBytes(value []byte, noLock ...bool) error {
+	return data.SetBytesContext(context.Background(), value, noLock...)
+}
+
+// SetBytesContext is the same as SetBytes, but gives up waiting for the database lock,
+// and stops scanning, once the context is done
+func (data *Data) SetBytesContext(ctx context.Context, value []byte, noLock ...bool) error {
+	return data.setValue(ctx, goutil.CloneBytes(value), noLock...)
+}
+
+
+// Codec encodes and decodes the values of a TypedTable
+type Codec interface {
+	Marshal(v any) ([]byte, error)
+	Unmarshal(data []byte, v any) error
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(v any) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v any) error {
+	return json.Unmarshal(data, v)
+}
+
+type gobCodec struct{}
+
+func (gobCodec) Marshal(v any) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gobCodec) Unmarshal(data []byte, v any) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+// JSONCodec encodes values with encoding/json
+var JSONCodec Codec = jsonCodec{}
+
+// GobCodec encodes values with encoding/gob
+var GobCodec Codec = gobCodec{}
+
+// TypedTable reads and writes Go values to the rows of a table
+//
+// each value is encoded with the Codec, and stored as the value of a row
+type TypedTable[T any] struct {
+	Table *Table
+	Codec Codec
+}
+
+// TypedRow is a key and decoded value returned by a TypedTable
+type TypedRow[T any] struct {
+	Key string
+	Value T
+}
+
+// NewTypedTable wraps a table to store values of type T
+//
+// @codec tells the table how to encode values (nil = JSONCodec)
+func NewTypedTable[T any](table *Table, codec Codec) *TypedTable[T] {
+	if codec == nil {
+		codec = JSONCodec
+	}
+
+	return &TypedTable[T]{
+		Table: table,
+		Codec: codec,
+	}
+}
+
+// Add encodes a value and adds it to the table as a new row
+func (tt *TypedTable[T]) Add(key string, value T, noLock ...bool) error {
+	buf, err := tt.Codec.Marshal(value)
+	if err != nil {
+		return err
+	}
+
+	_, err = tt.Table.AddRowBytes(key, buf, noLock...)
+	return err
+}
+
+// Get retrieves a row from the table and decodes its value
+func (tt *TypedTable[T]) Get(key string, noLock ...bool) (T, error) {
+	var value T
+
+	row, err := tt.Table.GetRow(key, noLock...)
+	if err != nil {
+		return value, err
+	}
+
+	err = tt.Codec.Unmarshal(row.GetBytes(), &value)
+	return value, err
+}
+
+// Set encodes a value and replaces the value of an existing row
+func (tt *TypedTable[T]) Set(key string, value T, noLock ...bool) error {
+	buf, err := tt.Codec.Marshal(value)
+	if err != nil {
+		return err
+	}
+
+	if len(noLock) == 0 || noLock[0] == false {
+		tt.Table.db.mu.Lock()
+		defer tt.Table.db.mu.Unlock()
+	}
+
+	row, err := tt.Table.GetRow(key, true)
+	if err != nil {
+		return err
+	}
+
+	return row.SetBytes(buf, true)
+}
+
+// Find decodes the value of every row with a key accepted by the matcher
+//
+// rows that fail to decode are skipped
+func (tt *TypedTable[T]) Find(key Matcher, noLock ...bool) ([]TypedRow[T], error) {
+	resRow := []TypedRow[T]{}
+
+	rows, err := tt.Table.FindRowsMatch(key, Any(), noLock...)
+	if err != nil {
+		return resRow, err
+	}
+
+	for _, row := range rows {
+		var value T
+		if err := tt.Codec.Unmarshal(row.GetBytes(), &value); err == nil {
+			resRow = append(resRow, TypedRow[T]{Key: row.Key, Value: value})
+		}
+	}
+
+	if len(resRow) == 0 {
+		return resRow, io.EOF
+	}
+
+	return resRow, nil
+}
@@ -0,0 +1,144 @@
+package db
+
+import (
+	"context"
+	"sync"
+)
+
+// ChangeOp is the kind of write that caused a Change
+type ChangeOp string
+
+const (
+	OpAddTable ChangeOp = "add_table"
+	OpRenameTable ChangeOp = "rename_table"
+	OpDelTable ChangeOp = "del_table"
+
+	OpAddRow ChangeOp = "add_row"
+	OpSetRow ChangeOp = "set_row"
+	OpRenameRow ChangeOp = "rename_row"
+	OpDelRow ChangeOp = "del_row"
+
+	OpAddData ChangeOp = "add_data"
+	OpSetData ChangeOp = "set_data"
+	OpDelData ChangeOp = "del_data"
+)
+
+// Change describes a write to the database
+//
+// Table is empty for changes to key value pairs (Data),
+// and Key is empty for changes to a table
+type Change struct {
+	Op ChangeOp `json:"op"`
+	Table string `json:"table,omitempty"`
+	Key string `json:"key,omitempty"`
+
+	// OldTable and OldKey are set when a table or row is renamed
+	OldTable string `json:"old_table,omitempty"`
+	OldKey string `json:"old_key,omitempty"`
+
+	OldValue string `json:"old_value,omitempty"`
+	NewValue string `json:"new_value,omitempty"`
+}
+
+// watcher queues changes for a single Watch channel
+type watcher struct {
+	filter func(change Change) bool
+	mu sync.Mutex
+	queue []Change
+	signal chan struct{}
+}
+
+// Watch returns a channel that receives every change to the database, after it is written
+//
+// @filter is called for each change, and can return false to skip it (nil = every change)
+//
+// changes are queued for each watcher, so a slow reader never blocks a write, and never misses a change
+//
+// the channel is closed once the context is done
+func (db *Database) Watch(ctx context.Context, filter func(change Change) bool) <-chan Change {
+	w := &watcher{
+		filter: filter,
+		signal: make(chan struct{}, 1),
+	}
+
+	db.watchMu.Lock()
+	if db.watchers == nil {
+		db.watchers = map[*watcher]bool{}
+	}
+	db.watchers[w] = true
+	db.watchMu.Unlock()
+
+	out := make(chan Change)
+
+	go func(){
+		defer func(){
+			db.watchMu.Lock()
+			delete(db.watchers, w)
+			db.watchMu.Unlock()
+
+			close(out)
+		}()
+
+		for {
+			w.mu.Lock()
+			if len(w.queue) == 0 {
+				w.mu.Unlock()
+
+				select {
+				case <-w.signal:
+					continue
+				case <-ctx.Done():
+					return
+				}
+			}
+
+			change := w.queue[0]
+			w.queue[0] = Change{}
+			w.queue = w.queue[1:]
+			w.mu.Unlock()
+
+			if w.filter != nil && !w.filter(change) {
+				continue
+			}
+
+			select {
+			case out <- change:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return out
+}
+
+// notify writes a change to the change log, sends it to every watcher, and then runs the after hooks
+//
+// this method never blocks on a watcher, so it can be called while the database lock is held
+//
+// the write is already stored, so an error from the change log cannot undo it,
+// but it is returned as a *ChangeLogError, so the caller knows the log is missing the change
+func (db *Database) notify(change Change) error {
+	logErr := db.logChange(change)
+
+	db.watchMu.Lock()
+	for w := range db.watchers {
+		w.mu.Lock()
+		w.queue = append(w.queue, change)
+		w.mu.Unlock()
+
+		select {
+		case w.signal <- struct{}{}:
+		default:
+		}
+	}
+	db.watchMu.Unlock()
+
+	// the hooks run last, so a write made by a hook is queued after this change, the same as in the change log
+	db.afterWrite(change)
+
+	if logErr != nil {
+		return &ChangeLogError{Err: logErr}
+	}
+	return nil
+}